@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
+	"github.com/urfave/negroni"
+)
+
+// adminAPI serves operations for the registry's operators. It is not
+// authenticated, so it should only listen where they can reach it.
+type adminAPI struct {
+	*negroni.Negroni
+	listenAddress string
+	store         *storeManager
+	// pushCredentials are used for pushes to their registry that don't bring
+	// their own.
+	pushCredentials registryCredentials
+}
+
+func NewAdminAPI(listenAddress string, store *storeManager, pushCredentials registryCredentials) *adminAPI {
+	server := &adminAPI{listenAddress: listenAddress, Negroni: negroni.Classic(), store: store, pushCredentials: pushCredentials}
+	httpHandler := mux.NewRouter()
+
+	httpHandler.HandleFunc("/admin/stacks/{stack}/rootfs", server.importRootfs).Methods("PUT")
+	httpHandler.HandleFunc("/admin/images/{name}/tags/{tag}", server.convertDroplet).Methods("PUT")
+	httpHandler.HandleFunc("/admin/push", server.pushImage).Methods("POST")
+
+	server.UseHandler(httpHandler)
+	return server
+}
+
+func (a *adminAPI) ListenAndServe() {
+	a.Run(a.listenAddress)
+}
+
+type importRootfsRequest struct {
+	Path string `json:"path"`
+}
+
+type stackResponse struct {
+	Stack   string       `json:"stack"`
+	Layers  []descriptor `json:"layers"`
+	DiffIDs []string     `json:"diff_ids"`
+}
+
+// importRootfs imports a new rootfs for a stack while the registry is
+// running. Manifests built afterwards are based on it, while the blobs of the
+// previous rootfs are left in the store.
+func (a *adminAPI) importRootfs(w http.ResponseWriter, r *http.Request) {
+	stack := mux.Vars(r)["stack"]
+
+	var request importRootfsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Path == "" {
+		http.Error(w, `expected a JSON body like {"path": "/path/to/rootfs"}`, http.StatusBadRequest)
+		return
+	}
+
+	if err := a.store.importRootfs(stack, request.Path); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	rootfs := a.store.stackRootfs(stack)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stackResponse{Stack: stack, Layers: rootfs.layers, DiffIDs: rootfs.diffIDs})
+}
+
+type convertDropletRequest struct {
+	DropletPath string       `json:"droplet_path"`
+	Metadata    capi.Droplet `json:"metadata"`
+	ProcessType string       `json:"process_type"`
+}
+
+type imageResponse struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+}
+
+// convertDroplet converts a droplet tarball into a tagged image in the store.
+// A JSON body names a droplet on the registry's host with droplet_path, while
+// a multipart/form-data body uploads it as its "droplet" part, after an
+// optional "request" part holding the rest of the JSON request.
+func (a *adminAPI) convertDroplet(w http.ResponseWriter, r *http.Request) {
+	name, tag, err := parseImageReference(mux.Vars(r)["name"] + ":" + mux.Vars(r)["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request convertDropletRequest
+	var droplet io.Reader
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.DropletPath == "" {
+			http.Error(w, `expected a JSON body like {"droplet_path": "/path/to/droplet.tgz"}`, http.StatusBadRequest)
+			return
+		}
+		dropletFile, err := os.Open(request.DropletPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		defer dropletFile.Close()
+		droplet = dropletFile
+
+	case "multipart/form-data":
+		parts, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for droplet == nil {
+			part, err := parts.NextPart()
+			if err != nil {
+				http.Error(w, `expected a "droplet" part`, http.StatusBadRequest)
+				return
+			}
+			switch part.FormName() {
+			case "request":
+				if err := json.NewDecoder(part).Decode(&request); err != nil {
+					http.Error(w, `"request" part is not a JSON request`, http.StatusBadRequest)
+					return
+				}
+			case "droplet":
+				droplet = part
+			}
+		}
+
+	default:
+		http.Error(w, "expected an application/json or multipart/form-data body", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	digest, err := a.store.ConvertDroplet(droplet, name+":"+tag, request.Metadata, request.ProcessType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(imageResponse{Image: name + ":" + tag, Digest: digest})
+}
+
+type pushImageRequest struct {
+	Image       string `json:"image"`
+	Destination string `json:"destination"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+}
+
+// pushImage pushes an image in the store to another registry, as the user in
+// the request if there is one. Since anyone who can reach the admin API can
+// name the destination, the configured credentials are only used for their
+// own registry, and pushes anywhere else are anonymous unless the request
+// brings credentials.
+func (a *adminAPI) pushImage(w http.ResponseWriter, r *http.Request) {
+	var request pushImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Image == "" || request.Destination == "" {
+		http.Error(w, `expected a JSON body like {"image": "my-app:1.2.3", "destination": "registry.example.com/team/my-app:1.2.3"}`, http.StatusBadRequest)
+		return
+	}
+	dest, err := parseRemoteReference(request.Destination)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	credentials := a.pushCredentials
+	if request.Username != "" {
+		credentials = registryCredentials{host: dest.host(), username: request.Username, password: request.Password}
+	}
+
+	report, err := a.store.PushImage(request.Image, request.Destination, credentials)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
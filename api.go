@@ -1,34 +1,59 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
 	"github.com/urfave/negroni"
 )
 
-const manifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+const (
+	manifestMediaType          = "application/vnd.docker.distribution.manifest.v2+json"
+	configMediaType            = "application/vnd.docker.container.image.v1+json"
+	layerMediaType             = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	uncompressedLayerMediaType = "application/vnd.docker.image.rootfs.diff.tar"
+)
 
 type api struct {
 	*negroni.Negroni
 	listenAddress string
 	store         *storeManager
+	auth          *tokenAuth
+	blobURLs      *blobURLs
 }
 
-func NewAPI(listenAddress string, store *storeManager) *api {
+// NewAPI creates the registry API. If auth is nil, it is unauthenticated.
+// Blob requests are redirected to URLs signed by blobURLs.
+func NewAPI(listenAddress string, store *storeManager, auth *tokenAuth, blobURLs *blobURLs) *api {
 	if listenAddress == "" {
 		panic("please set --listen-address")
 	}
 
-	server := &api{listenAddress: listenAddress, Negroni: negroni.Classic(), store: store}
+	server := &api{listenAddress: listenAddress, Negroni: negroni.Classic(), store: store, auth: auth, blobURLs: blobURLs}
 	httpHandler := mux.NewRouter()
 
-	httpHandler.HandleFunc("/v2/", server.emptyBody).Methods("GET")
-	httpHandler.HandleFunc("/v2/{app-guid}/manifests/{tag}", server.getManifest).Methods("GET")
-	httpHandler.HandleFunc("/v2/{app-guid}/blobs/{digest}", server.redirectBlob).Methods("GET")
-	httpHandler.HandleFunc("/foreign-blobs/{digest}", server.getBlob).Methods("GET")
+	httpHandler.HandleFunc("/v2/", server.authorize(server.emptyBody)).Methods("GET", "HEAD")
+	httpHandler.HandleFunc("/v2/{app-guid}/manifests/{reference}", server.authorize(server.getManifest)).Methods("GET", "HEAD")
+	httpHandler.HandleFunc("/v2/{app-guid}/blobs/{digest}", server.authorize(server.redirectBlob)).Methods("GET", "HEAD")
+	blobs := &blobAPI{store: store, blobURLs: blobURLs}
+	httpHandler.HandleFunc("/foreign-blobs/{digest}", blobs.getBlob).Methods("GET", "HEAD")
+	if auth != nil {
+		httpHandler.HandleFunc("/token", auth.issueToken).Methods("GET")
+	}
 
+	// clients use this header to tell a v2 registry from a v1 one
+	server.UseFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		next(w, r)
+	})
 	server.UseHandler(httpHandler)
 	return server
 }
@@ -37,6 +62,29 @@ func (a *api) ListenAndServe() {
 	a.Run(a.listenAddress)
 }
 
+// ListenAndServeTLS serves the API over TLS, with certificates provided by
+// certs.
+func (a *api) ListenAndServeTLS(certs *certReloader) {
+	server := &http.Server{Addr: a.listenAddress, Handler: a, TLSConfig: certs.tlsConfig()}
+	a.store.logger.Printf("listening on %s with TLS", a.listenAddress)
+	a.store.logger.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+func (a *api) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	if a.auth == nil {
+		return handler
+	}
+	return a.auth.authorize(handler)
+}
+
+// capiClient returns the client to make CAPI calls for a request with.
+func (a *api) capiClient(r *http.Request) (*capi.Client, error) {
+	if a.auth == nil {
+		return a.store.capi, nil
+	}
+	return a.auth.capiClient(r)
+}
+
 func (a *api) emptyBody(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
@@ -45,22 +93,95 @@ func (a *api) getManifest(w http.ResponseWriter, r *http.Request) {
 	pathParams := mux.Vars(r)
 	appGUID := pathParams["app-guid"]
 
-	w.Header().Add("Content-Type", manifestMediaType)
-	a.store.AppManifest(w, appGUID)
-}
+	cf, err := a.capiClient(r)
+	if err != nil {
+		// without a challenge docker won't fetch a new token
+		a.auth.challenge(w, r, appGUID, "")
+		writeError(w, http.StatusUnauthorized, errCodeUnauthorized, err.Error())
+		return
+	}
 
-func (a *api) redirectBlob(w http.ResponseWriter, r *http.Request) {
-	pathParams := mux.Vars(r)
-	blobDigest := pathParams["digest"]
+	if !acceptsManifest(r) {
+		writeError(w, http.StatusNotFound, errCodeManifestUnknown, "manifests are only available as "+manifestMediaType)
+		return
+	}
 
-	http.Redirect(w, r, "/foreign-blobs/"+blobDigest, http.StatusTemporaryRedirect)
+	// references with an algorithm are digests, and anything else is a tag,
+	// which always means the app's current image
+	var body bytes.Buffer
+	reference := pathParams["reference"]
+	if strings.Contains(reference, ":") {
+		var manifestChecksum string
+		manifestChecksum, err = digestHex(reference)
+		if err == nil {
+			err = a.store.AppManifestByDigest(&body, appGUID, manifestChecksum, cf)
+		} else {
+			err = unknownManifestError{appGUID: appGUID, digest: reference}
+		}
+	} else {
+		err = a.store.AppManifest(&body, appGUID, cf)
+	}
+	switch {
+	case err == nil:
+		checksum := sha256.Sum256(body.Bytes())
+		w.Header().Set("Content-Type", manifestMediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+		w.Header().Set("Docker-Content-Digest", "sha256:"+hex.EncodeToString(checksum[:]))
+		if r.Method != "HEAD" {
+			w.Write(body.Bytes())
+		}
+	case errors.As(err, &unknownStackError{}), errors.As(err, &unknownManifestError{}):
+		writeError(w, http.StatusNotFound, errCodeManifestUnknown, err.Error())
+	case capi.IsNotFound(err):
+		writeError(w, http.StatusNotFound, errCodeNameUnknown, err.Error())
+	case capi.IsForbidden(err):
+		writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, errCodeUnknown, err.Error())
+	}
+}
+
+// acceptsManifest reports whether a client accepts the manifests the registry
+// serves. Clients that don't send an Accept header get them anyway.
+func acceptsManifest(r *http.Request) bool {
+	accepts := r.Header["Accept"]
+	if len(accepts) == 0 {
+		return true
+	}
+	for _, accept := range accepts {
+		for _, mediaType := range strings.Split(accept, ",") {
+			switch strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]) {
+			case manifestMediaType, "*/*", "application/*":
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (a *api) getBlob(w http.ResponseWriter, r *http.Request) {
+// redirectBlob sends clients to where a blob is served, once it has checked
+// that the blob belongs to one of the app's manifests.
+func (a *api) redirectBlob(w http.ResponseWriter, r *http.Request) {
 	pathParams := mux.Vars(r)
+	appGUID := pathParams["app-guid"]
 	blobDigest := pathParams["digest"]
 
-	a.store.GetBlob(w, strings.Split(blobDigest, ":")[1])
+	blobChecksum, err := digestHex(blobDigest)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
+	found, err := a.store.AppHasBlob(appGUID, blobChecksum)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeUnknown, err.Error())
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errCodeBlobUnknown, "app "+appGUID+" has no blob "+blobDigest)
+		return
+	}
+
+	http.Redirect(w, r, a.blobURLs.url(blobDigest, time.Now()), http.StatusTemporaryRedirect)
 }
 
 type descriptor struct {
@@ -71,7 +192,7 @@ type descriptor struct {
 
 func layerDescriptor(digest string, size int64) descriptor {
 	return descriptor{
-		MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+		MediaType: layerMediaType,
 		Digest:    "sha256:" + digest,
 		Size:      size,
 	}
@@ -79,7 +200,7 @@ func layerDescriptor(digest string, size int64) descriptor {
 
 func configDescriptor(digest string, size int64) descriptor {
 	return descriptor{
-		MediaType: "application/vnd.docker.container.image.v1+json",
+		MediaType: configMediaType,
 		Digest:    "sha256:" + digest,
 		Size:      size,
 	}
@@ -91,7 +212,9 @@ type imageConfig struct {
 }
 
 type containerConfig struct {
-	User string `json:"user"`
+	User       string   `json:"user"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
 }
 
 type rootfs struct {
@@ -99,11 +222,18 @@ type rootfs struct {
 	DiffIDs []string `json:"diff_ids"`
 }
 
-func createImageConfig(diffIDs ...string) imageConfig {
-	return imageConfig{
+// createImageConfig returns the config of an image. A non-empty command is
+// run the way Diego runs a process's command, from the app's directory.
+func createImageConfig(command string, diffIDs ...string) imageConfig {
+	config := imageConfig{
 		ContainerConfig: containerConfig{User: "vcap"},
 		Rootfs:          rootfs{Type: "layers", DiffIDs: diffIDs},
 	}
+	if command != "" {
+		config.ContainerConfig.Cmd = []string{"/bin/bash", "-c", command}
+		config.ContainerConfig.WorkingDir = dropletRoot + "/app"
+	}
+	return config
 }
 
 type manifest struct {
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
+)
+
+const tokenLifetime = 5 * time.Minute
+
+// tokenAuth implements the Docker Registry v2 token authentication flow. The
+// token endpoint authenticates users against UAA and grants pulls of apps
+// whose spaces they are developers or auditors of, according to CAPI.
+//
+// With callerIdentity set, the user's UAA token is sealed into the registry
+// token, and CAPI calls for their requests are made with it rather than the
+// registry's own token, leaving authorization to CAPI.
+type tokenAuth struct {
+	uaa            *uaaClient
+	store          *storeManager
+	secret         []byte
+	callerIdentity bool
+}
+
+// newTokenAuth signs tokens with secret, or with a random key if it is empty,
+// in which case tokens don't survive restarts.
+func newTokenAuth(uaa *uaaClient, store *storeManager, secret string, callerIdentity bool) *tokenAuth {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		_, err := rand.Read(key)
+		must("generate token signing key", err)
+	}
+	return &tokenAuth{uaa: uaa, store: store, secret: key, callerIdentity: callerIdentity}
+}
+
+type accessClaim struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+type tokenClaims struct {
+	Subject   string        `json:"sub"`
+	UserName  string        `json:"user_name"`
+	Audience  string        `json:"aud"`
+	IssuedAt  int64         `json:"iat"`
+	ExpiresAt int64         `json:"exp"`
+	Access    []accessClaim `json:"access"`
+	// CAPIToken is the user's sealed UAA token when using caller identity.
+	CAPIToken string `json:"capi_token,omitempty"`
+}
+
+func (c tokenClaims) canPull(appGUID string) bool {
+	for _, access := range c.Access {
+		if access.Type == "repository" && access.Name == appGUID && containsString(access.Actions, "pull") {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// issueToken is the token endpoint. Users authenticate with basic auth, using
+// either their CF username and password or a UAA access token as password.
+func (t *tokenAuth) issueToken(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "log in with your CF username and password, or a UAA token as password")
+		return
+	}
+
+	user, accessToken, err := t.authenticate(username, password)
+	if err != nil {
+		if _, ok := err.(invalidCredentialsError); ok {
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, err.Error())
+			return
+		}
+		writeError(w, http.StatusBadGateway, errCodeUnknown, err.Error())
+		return
+	}
+
+	now := time.Now()
+	claims := tokenClaims{
+		Subject:   user.UserID,
+		UserName:  user.UserName,
+		Audience:  r.URL.Query().Get("service"),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tokenLifetime).Unix(),
+		Access:    []accessClaim{},
+	}
+	cf := t.store.capi
+	if t.callerIdentity {
+		cf = cf.WithToken("bearer " + accessToken)
+		if claims.CAPIToken, err = t.seal(accessToken); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeUnknown, err.Error())
+			return
+		}
+		// the registry token is no use once the UAA token has expired
+		if expiry := jwtExpiry(accessToken); expiry != 0 && expiry < claims.ExpiresAt {
+			claims.ExpiresAt = expiry
+		}
+	}
+	for _, scope := range r.URL.Query()["scope"] {
+		parts := strings.Split(scope, ":")
+		if len(parts) != 3 || parts[0] != "repository" || !containsString(strings.Split(parts[2], ","), "pull") {
+			continue
+		}
+		allowed, err := userCanPull(cf, user.UserID, parts[1])
+		if err != nil {
+			writeError(w, http.StatusBadGateway, errCodeUnknown, err.Error())
+			return
+		}
+		if allowed {
+			claims.Access = append(claims.Access, accessClaim{Type: "repository", Name: parts[1], Actions: []string{"pull"}})
+		}
+	}
+
+	token, err := t.sign(claims)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeUnknown, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(claims.ExpiresAt - claims.IssuedAt),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	})
+}
+
+// authenticate returns the user and a UAA access token for them.
+func (t *tokenAuth) authenticate(username, password string) (uaaUser, string, error) {
+	accessToken := strings.TrimSpace(password)
+	if strings.HasPrefix(strings.ToLower(accessToken), "bearer ") {
+		accessToken = strings.TrimSpace(accessToken[len("bearer "):])
+	}
+	if !isJWT(accessToken) {
+		var err error
+		if accessToken, err = t.uaa.passwordGrant(username, password); err != nil {
+			return uaaUser{}, "", err
+		}
+	}
+	user, err := t.uaa.userInfo(accessToken)
+	return user, accessToken, err
+}
+
+// capiClient returns the client to make CAPI calls for an authorized request
+// with.
+func (t *tokenAuth) capiClient(r *http.Request) (*capi.Client, error) {
+	if !t.callerIdentity {
+		return t.store.capi, nil
+	}
+	claims, _ := r.Context().Value(claimsKey{}).(tokenClaims)
+	accessToken, err := t.unseal(claims.CAPIToken)
+	if err != nil {
+		return nil, err
+	}
+	return t.store.capi.WithToken("bearer " + accessToken), nil
+}
+
+type claimsKey struct{}
+
+// authorize wraps registry API handlers, requiring a valid token and, for
+// requests about an app, one granting pulls of it.
+func (t *tokenAuth) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appGUID := mux.Vars(r)["app-guid"]
+
+		claims, err := t.verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil {
+			t.challenge(w, r, appGUID, "")
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, err.Error())
+			return
+		}
+		if appGUID != "" && !claims.canPull(appGUID) {
+			t.challenge(w, r, appGUID, "insufficient_scope")
+			writeError(w, http.StatusUnauthorized, errCodeDenied, fmt.Sprintf("%s may not pull app %s", claims.UserName, appGUID))
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	}
+}
+
+func (t *tokenAuth) challenge(w http.ResponseWriter, r *http.Request, appGUID, challengeErr string) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	challenge := fmt.Sprintf(`Bearer realm="%s://%s/token",service="%s"`, scheme, r.Host, r.Host)
+	if appGUID != "" {
+		challenge += fmt.Sprintf(`,scope="repository:%s:pull"`, appGUID)
+	}
+	if challengeErr != "" {
+		challenge += fmt.Sprintf(`,error="%s"`, challengeErr)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+}
+
+func (t *tokenAuth) sign(claims tokenClaims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(t.mac(signed)), nil
+}
+
+func (t *tokenAuth) verify(token string) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, errors.New("authentication required")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, t.mac(parts[0]+"."+parts[1])) {
+		return tokenClaims{}, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return tokenClaims{}, errors.New("invalid token payload")
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return tokenClaims{}, errors.New("invalid token payload")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return tokenClaims{}, errors.New("token has expired")
+	}
+	return claims, nil
+}
+
+// seal encrypts a UAA token for inclusion in a registry token, which is only
+// signed.
+func (t *tokenAuth) seal(accessToken string) (string, error) {
+	aead, err := t.aead()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(accessToken), nil)), nil
+}
+
+func (t *tokenAuth) unseal(sealed string) (string, error) {
+	aead, err := t.aead()
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(ciphertext) < aead.NonceSize() {
+		return "", errors.New("token has no CAPI credentials")
+	}
+	accessToken, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("token has invalid CAPI credentials")
+	}
+	return string(accessToken), nil
+}
+
+func (t *tokenAuth) aead() (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte("capi-token:"), t.secret...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// isJWT reports whether a password is a JWT, such as a UAA access token,
+// rather than a password that happens to have two dots in it.
+func isJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	var fields struct {
+		Algorithm string `json:"alg"`
+	}
+	return json.Unmarshal(header, &fields) == nil && fields.Algorithm != ""
+}
+
+// jwtExpiry returns the expiry of a JWT without verifying it, or 0 if it
+// can't be read.
+func jwtExpiry(token string) int64 {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0
+	}
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	json.Unmarshal(payload, &claims)
+	return claims.ExpiresAt
+}
+
+func (t *tokenAuth) mac(signed string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
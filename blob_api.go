@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+// blobAPI serves blobs at the signed URLs the registry API redirects blob
+// requests to. The registry API serves it too, but it can also listen on its
+// own, so that a CDN or caching proxy can be put in front of just the blobs.
+type blobAPI struct {
+	*negroni.Negroni
+	listenAddress string
+	store         *storeManager
+	blobURLs      *blobURLs
+}
+
+func NewBlobAPI(listenAddress string, store *storeManager, blobURLs *blobURLs) *blobAPI {
+	server := &blobAPI{listenAddress: listenAddress, Negroni: negroni.Classic(), store: store, blobURLs: blobURLs}
+	httpHandler := mux.NewRouter()
+
+	httpHandler.HandleFunc("/foreign-blobs/{digest}", server.getBlob).Methods("GET", "HEAD")
+
+	server.UseHandler(httpHandler)
+	return server
+}
+
+func (b *blobAPI) ListenAndServe() {
+	b.Run(b.listenAddress)
+}
+
+// ListenAndServeTLS serves blobs over TLS, with certificates provided by
+// certs.
+func (b *blobAPI) ListenAndServeTLS(certs *certReloader) {
+	server := &http.Server{Addr: b.listenAddress, Handler: b, TLSConfig: certs.tlsConfig()}
+	b.store.logger.Printf("serving blobs on %s with TLS", b.listenAddress)
+	b.store.logger.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+func (b *blobAPI) getBlob(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	blobDigest := pathParams["digest"]
+
+	blobChecksum, err := digestHex(blobDigest)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
+	now := time.Now()
+	expiry, err := b.blobURLs.verify(blobDigest, r.URL.Query(), now)
+	if err != nil {
+		writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+		return
+	}
+	blob, err := b.store.OpenBlob(blobChecksum)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, errCodeBlobUnknown, "blob "+blobDigest+" is not in the store")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeUnknown, err.Error())
+		return
+	}
+	defer blob.Close()
+
+	// Blobs are named after their digest, so they never change, but caches
+	// mustn't serve them for longer than the URL is valid, or they would
+	// outlive its expiry. ServeContent takes care of HEAD, range and
+	// conditional requests.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", blobDigest)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int(expiry.Sub(now).Seconds())))
+	w.Header().Set("Expires", expiry.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", `"`+blobDigest+`"`)
+	http.ServeContent(w, r, "", time.Time{}, blob)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blobURLLifetime is the shortest time a blob URL is valid for. Expiries are
+// aligned to multiples of it, so that every URL minted for a blob within one
+// window is the same, and caches keyed by URL can serve it again.
+const blobURLLifetime = 10 * time.Minute
+
+// blobURLs mints the URLs blob requests are redirected to. They carry an
+// expiry and an HMAC of it and the digest, like presigned object store URLs,
+// so the foreign blob endpoint only serves requests that an authorised
+// registry request was redirected from.
+type blobURLs struct {
+	secret []byte
+	// baseURL is where the foreign blob endpoint is reachable, e.g. through
+	// a CDN. URLs are relative to the registry API if it is empty.
+	baseURL string
+}
+
+// newBlobURLs signs URLs with secret, or with a random key if it is empty,
+// in which case URLs don't survive restarts and other instances of the
+// registry don't accept them.
+func newBlobURLs(secret, baseURL string) *blobURLs {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		_, err := rand.Read(key)
+		must("generate blob URL signing key", err)
+	}
+	return &blobURLs{secret: key, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// url returns the signed URL of a blob, which is valid for between one and
+// two blobURLLifetimes.
+func (b *blobURLs) url(digest string, now time.Time) string {
+	expires := strconv.FormatInt(now.Truncate(blobURLLifetime).Add(2*blobURLLifetime).Unix(), 10)
+	query := url.Values{"expires": {expires}, "signature": {b.signature(digest, expires)}}
+	return b.baseURL + "/foreign-blobs/" + digest + "?" + query.Encode()
+}
+
+// verify checks that a request for a blob has a valid, unexpired signature,
+// returning when it expires.
+func (b *blobURLs) verify(digest string, query url.Values, now time.Time) (time.Time, error) {
+	expires := query.Get("expires")
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("signature"))
+	if expires == "" || err != nil || len(signature) == 0 {
+		return time.Time{}, errors.New("blob URLs must be signed; request blobs through the registry API")
+	}
+	if !hmac.Equal(signature, b.mac(digest, expires)) {
+		return time.Time{}, errors.New("blob URL has an invalid signature")
+	}
+	expiry, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() >= expiry {
+		return time.Time{}, errors.New("blob URL has expired")
+	}
+	return time.Unix(expiry, 0), nil
+}
+
+func (b *blobURLs) signature(digest, expires string) string {
+	return base64.RawURLEncoding.EncodeToString(b.mac(digest, expires))
+}
+
+func (b *blobURLs) mac(digest, expires string) []byte {
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write([]byte(digest + "\n" + expires))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForeignBlobsRequireSignedURLs(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := newConformanceClient(t, registry)
+
+	configDigest := (&dockerClient{t: t, registry: registry.URL}).pull(appGUID).manifest.Config.Digest
+
+	response, _ := client.do("GET", "/v2/"+appGUID+"/blobs/"+configDigest, nil)
+	client.expectStatus(response, http.StatusTemporaryRedirect)
+	location, err := response.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _ = client.do("GET", location.RequestURI(), nil)
+	client.expectStatus(response, http.StatusOK)
+
+	otherDigest := "sha256:" + strings.Repeat("0", 64)
+	otherSignature, err := url.Parse(registry.blobURLs.url(otherDigest, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, path := range map[string]string{
+		"unsigned":          "/foreign-blobs/" + configDigest,
+		"expired":           registry.blobURLs.url(configDigest, time.Now().Add(-2*blobURLLifetime)),
+		"another signature": "/foreign-blobs/" + configDigest + "?" + otherSignature.RawQuery,
+		"another key":       newBlobURLs("", "").url(configDigest, time.Now()),
+	} {
+		response, body := client.do("GET", path, nil)
+		if response.StatusCode != http.StatusForbidden {
+			t.Errorf("%s URL: expected status 403, got %s", name, response.Status)
+			continue
+		}
+		client.expectError(response, body, http.StatusForbidden, errCodeDenied)
+	}
+}
+
+func TestBlobURLsAreAlignedToWindows(t *testing.T) {
+	blobs := newBlobURLs("some-secret", "https://blobs.example.com/")
+	digest := "sha256:" + strings.Repeat("0", 64)
+	windowStart := time.Unix(0, 0).Add(1000 * blobURLLifetime)
+
+	first := blobs.url(digest, windowStart)
+	if !strings.HasPrefix(first, "https://blobs.example.com/foreign-blobs/"+digest+"?") {
+		t.Errorf("URL %q doesn't use the base URL", first)
+	}
+	if last := blobs.url(digest, windowStart.Add(blobURLLifetime-time.Second)); last != first {
+		t.Errorf("URLs minted in the same window differ: %q and %q", first, last)
+	}
+	if next := blobs.url(digest, windowStart.Add(blobURLLifetime)); next == first {
+		t.Errorf("URLs minted in the next window are the same")
+	}
+
+	signed, err := url.Parse(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry, err := blobs.verify(digest, signed.Query(), windowStart.Add(2*blobURLLifetime-time.Second))
+	if err != nil {
+		t.Errorf("URL expired before two windows had passed: %s", err)
+	}
+	if !expiry.Equal(windowStart.Add(2 * blobURLLifetime)) {
+		t.Errorf("URL expires at %s", expiry)
+	}
+	if _, err := blobs.verify(digest, signed.Query(), windowStart.Add(2*blobURLLifetime)); err == nil {
+		t.Errorf("URL is still valid after two windows")
+	}
+}
+
+func TestBlobListener(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	blobServer := httptest.NewServer(NewBlobAPI("127.0.0.1:0", registry.store, registry.blobURLs))
+	defer blobServer.Close()
+	registry.blobURLs.baseURL = blobServer.URL
+	client := newConformanceClient(t, registry)
+
+	configDigest := (&dockerClient{t: t, registry: registry.URL}).pull(appGUID).manifest.Config.Digest
+	response, _ := client.do("GET", "/v2/"+appGUID+"/blobs/"+configDigest, nil)
+	client.expectStatus(response, http.StatusTemporaryRedirect)
+	location := response.Header.Get("Location")
+	if !strings.HasPrefix(location, blobServer.URL+"/foreign-blobs/") {
+		t.Fatalf("redirected to %q instead of the blob listener", location)
+	}
+
+	blobClient := &conformanceClient{t: t, registry: blobServer.URL}
+	response, _ = blobClient.do("GET", strings.TrimPrefix(location, blobServer.URL), nil)
+	blobClient.expectStatus(response, http.StatusOK)
+	var maxAge int
+	cacheControl := response.Header.Get("Cache-Control")
+	if _, err := fmt.Sscanf(cacheControl, "public, max-age=%d, immutable", &maxAge); err != nil || maxAge <= 0 || maxAge > int((2*blobURLLifetime).Seconds()) {
+		t.Errorf("blob has Cache-Control %q, which should last no longer than its URL", cacheControl)
+	}
+	etag := response.Header.Get("ETag")
+	if etag != `"`+configDigest+`"` {
+		t.Errorf("blob has ETag %q", etag)
+	}
+
+	response, _ = blobClient.do("GET", strings.TrimPrefix(location, blobServer.URL), http.Header{"If-None-Match": {etag}})
+	blobClient.expectStatus(response, http.StatusNotModified)
+}
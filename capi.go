@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
+)
+
+// dropletKey identifies a droplet in the store by its checksum, so that
+// identical droplets of different apps are only downloaded and converted once.
+func dropletKey(droplet capi.Droplet) (string, error) {
+	if droplet.Checksum.Type != "sha256" && droplet.Checksum.Type != "sha1" {
+		return "", fmt.Errorf("droplet has unsupported checksum type %q", droplet.Checksum.Type)
+	}
+	if decoded, err := hex.DecodeString(droplet.Checksum.Value); err != nil || len(decoded) != dropletChecksumHash(droplet).Size() {
+		return "", fmt.Errorf("droplet has invalid %s checksum %q", droplet.Checksum.Type, droplet.Checksum.Value)
+	}
+	return "droplet-" + droplet.Checksum.Type + "-" + strings.ToLower(droplet.Checksum.Value), nil
+}
+
+func dropletChecksumHash(droplet capi.Droplet) hash.Hash {
+	if droplet.Checksum.Type == "sha1" {
+		return sha1.New()
+	}
+	return sha256.New()
+}
+
+// currentDroplet asks CAPI for the droplet an app currently runs.
+func currentDroplet(cf *capi.Client, appGUID string) (capi.Droplet, error) {
+	droplet, err := cf.CurrentDroplet(appGUID)
+	if err != nil {
+		return capi.Droplet{}, fmt.Errorf("getting current droplet of app %s: %w", appGUID, err)
+	}
+	if droplet.Stack == "" {
+		return capi.Droplet{}, fmt.Errorf("app %s doesn't run a buildpack droplet", appGUID)
+	}
+	return droplet, nil
+}
+
+// userCanPull reports whether a user is a developer or auditor of the space
+// an app is in. Users can see their own roles, so cf may use their token.
+func userCanPull(cf *capi.Client, userGUID, appGUID string) (bool, error) {
+	app, err := cf.App(appGUID)
+	if capi.IsNotFound(err) || capi.IsForbidden(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("getting app %s: %s", appGUID, err)
+	}
+
+	roles, err := cf.Roles(userGUID, app.Relationships.Space.Data.GUID, "space_developer", "space_auditor")
+	if err != nil {
+		return false, fmt.Errorf("getting roles of user %s: %s", userGUID, err)
+	}
+	return len(roles) > 0, nil
+}
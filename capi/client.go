@@ -0,0 +1,209 @@
+// Package capi is a small client for the Cloud Controller v3 API, covering
+// what the registry needs to find and download the droplets of apps.
+package capi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client makes requests to CAPI with a single token.
+type Client struct {
+	URL string
+	// Token is the Authorization header value, including the "bearer"
+	// prefix, as printed by `cf oauth-token`.
+	Token      string
+	HTTPClient *http.Client
+}
+
+// WithToken returns a copy of the client that uses another token, e.g. that
+// of a user the registry is acting for.
+func (c *Client) WithToken(token string) *Client {
+	withToken := *c
+	withToken.Token = token
+	return &withToken
+}
+
+// App gets an app.
+func (c *Client) App(appGUID string) (App, error) {
+	var app App
+	err := c.get("/v3/apps/"+url.PathEscape(appGUID), nil, &app)
+	return app, err
+}
+
+// CurrentDroplet gets the droplet an app currently runs.
+func (c *Client) CurrentDroplet(appGUID string) (Droplet, error) {
+	var droplet Droplet
+	err := c.get("/v3/apps/"+url.PathEscape(appGUID)+"/droplets/current", nil, &droplet)
+	return droplet, err
+}
+
+// Droplet gets a droplet.
+func (c *Client) Droplet(dropletGUID string) (Droplet, error) {
+	var droplet Droplet
+	err := c.get("/v3/droplets/"+url.PathEscape(dropletGUID), nil, &droplet)
+	return droplet, err
+}
+
+// Processes lists the processes of an app.
+func (c *Client) Processes(appGUID string) ([]Process, error) {
+	var processes []Process
+	err := c.list("/v3/apps/"+url.PathEscape(appGUID)+"/processes", nil, func(resources json.RawMessage) error {
+		var page []Process
+		err := json.Unmarshal(resources, &page)
+		processes = append(processes, page...)
+		return err
+	})
+	return processes, err
+}
+
+// Packages lists the packages of an app.
+func (c *Client) Packages(appGUID string) ([]Package, error) {
+	var packages []Package
+	err := c.list("/v3/apps/"+url.PathEscape(appGUID)+"/packages", nil, func(resources json.RawMessage) error {
+		var page []Package
+		err := json.Unmarshal(resources, &page)
+		packages = append(packages, page...)
+		return err
+	})
+	return packages, err
+}
+
+// Space gets a space.
+func (c *Client) Space(spaceGUID string) (Space, error) {
+	var space Space
+	err := c.get("/v3/spaces/"+url.PathEscape(spaceGUID), nil, &space)
+	return space, err
+}
+
+// Roles lists the roles a user has in a space, restricted to roleTypes if
+// any are given.
+func (c *Client) Roles(userGUID, spaceGUID string, roleTypes ...string) ([]Role, error) {
+	query := url.Values{"user_guids": {userGUID}, "space_guids": {spaceGUID}}
+	if len(roleTypes) > 0 {
+		query.Set("types", strings.Join(roleTypes, ","))
+	}
+
+	var roles []Role
+	err := c.list("/v3/roles", query, func(resources json.RawMessage) error {
+		var page []Role
+		err := json.Unmarshal(resources, &page)
+		roles = append(roles, page...)
+		return err
+	})
+	return roles, err
+}
+
+// DownloadDroplet starts downloading a droplet, following CAPI's redirect to
+// the blobstore. The caller must close the returned body.
+func (c *Client) DownloadDroplet(dropletGUID string) (io.ReadCloser, error) {
+	response, err := c.do(c.dropletDownloadRequest(dropletGUID), c.httpClient())
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// CheckDropletDownload checks that a droplet may be downloaded, without
+// following the redirect to the blobstore.
+func (c *Client) CheckDropletDownload(dropletGUID string) error {
+	noRedirects := *c.httpClient()
+	noRedirects.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	response, err := c.do(c.dropletDownloadRequest(dropletGUID), &noRedirects)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (c *Client) dropletDownloadRequest(dropletGUID string) *http.Request {
+	request, _ := http.NewRequest("GET", c.URL+"/v3/droplets/"+url.PathEscape(dropletGUID)+"/download", nil)
+	request.Header.Set("Authorization", c.Token)
+	return request
+}
+
+type page struct {
+	Pagination struct {
+		Next *struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"pagination"`
+	Resources json.RawMessage `json:"resources"`
+}
+
+// list gets every page of a list endpoint, passing the resources of each to
+// appendResources.
+func (c *Client) list(path string, query url.Values, appendResources func(json.RawMessage) error) error {
+	for {
+		var current page
+		if err := c.get(path, query, &current); err != nil {
+			return err
+		}
+		if err := appendResources(current.Resources); err != nil {
+			return fmt.Errorf("decoding %s: %s", path, err)
+		}
+		if current.Pagination.Next == nil || current.Pagination.Next.Href == "" {
+			return nil
+		}
+
+		next, err := url.Parse(current.Pagination.Next.Href)
+		if err != nil {
+			return fmt.Errorf("parsing next page of %s: %s", path, err)
+		}
+		path, query = next.Path, next.Query()
+	}
+}
+
+func (c *Client) get(path string, query url.Values, result interface{}) error {
+	requestURL := c.URL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	request, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", c.Token)
+	request.Header.Set("Accept", "application/json")
+
+	response, err := c.do(request, c.httpClient())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("decoding %s: %s", path, err)
+	}
+	return nil
+}
+
+// do makes a request, turning any response other than a 200 or a redirect
+// that wasn't followed into an *Error.
+func (c *Client) do(request *http.Request, httpClient *http.Client) (*http.Response, error) {
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusOK || (response.StatusCode >= 300 && response.StatusCode < 400) {
+		return response, nil
+	}
+
+	defer response.Body.Close()
+	return nil, parseError(response)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
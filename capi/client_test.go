@@ -0,0 +1,95 @@
+package capi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProcessesFollowsPagination(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/apps/some-app/processes" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("page") {
+		case "":
+			fmt.Fprintf(w, `{"pagination":{"next":{"href":"%s/v3/apps/some-app/processes?page=2"}},"resources":[{"guid":"web-guid","type":"web"}]}`, server.URL)
+		case "2":
+			fmt.Fprint(w, `{"pagination":{"next":null},"resources":[{"guid":"worker-guid","type":"worker"}]}`)
+		default:
+			t.Errorf("unexpected page %q", r.URL.Query().Get("page"))
+		}
+	}))
+	defer server.Close()
+
+	processes, err := (&Client{URL: server.URL}).Processes("some-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processes) != 2 || processes[0].Type != "web" || processes[1].Type != "worker" {
+		t.Errorf("got processes %+v", processes)
+	}
+}
+
+func TestErrorsAreParsed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "bearer some-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errors":[{"code":1000,"title":"CF-InvalidAuthToken","detail":"Invalid Auth Token"}]}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"code":10010,"title":"CF-ResourceNotFound","detail":"App not found"}]}`)
+	}))
+	defer server.Close()
+	client := &Client{URL: server.URL, Token: "bearer some-token"}
+
+	_, err := client.App("some-app")
+	if !IsNotFound(err) || IsForbidden(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "CF-ResourceNotFound: App not found") {
+		t.Errorf("expected the v3 error in the message, got %v", err)
+	}
+
+	_, err = client.WithToken("bearer wrong-token").CurrentDroplet("some-app")
+	if !IsForbidden(err) || IsNotFound(err) {
+		t.Errorf("expected a forbidden error, got %v", err)
+	}
+	if capiErr, ok := err.(*Error); !ok || len(capiErr.Errors) != 1 || capiErr.Errors[0].Code != 1000 {
+		t.Errorf("expected the v3 error details, got %#v", err)
+	}
+}
+
+func TestDownloadDropletWithoutAnHTTPClient(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/droplets/some-droplet/download":
+			http.Redirect(w, r, server.URL+"/blobstore/droplet", http.StatusFound)
+		case "/blobstore/droplet":
+			fmt.Fprint(w, "droplet contents")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	body, err := (&Client{URL: server.URL}).DownloadDroplet("some-droplet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "droplet contents" {
+		t.Errorf("downloaded %q", contents)
+	}
+}
@@ -0,0 +1,72 @@
+package capi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Error is an unsuccessful response from CAPI, or from the blobstore it
+// redirected to.
+type Error struct {
+	StatusCode int
+	Host       string
+	Errors     []ErrorDetail
+	// Body is the response body when it isn't in the v3 error format.
+	Body string
+}
+
+// ErrorDetail is an entry in the errors list of a v3 error response.
+type ErrorDetail struct {
+	Code   int    `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func (e *Error) Error() string {
+	var details []string
+	for _, detail := range e.Errors {
+		details = append(details, fmt.Sprintf("%s: %s", detail.Title, detail.Detail))
+	}
+	if len(details) == 0 && e.Body != "" {
+		details = append(details, e.Body)
+	}
+
+	message := fmt.Sprintf("%s responded %d %s", e.Host, e.StatusCode, http.StatusText(e.StatusCode))
+	if len(details) > 0 {
+		message += ": " + strings.Join(details, "; ")
+	}
+	return message
+}
+
+// IsNotFound reports whether err is a 404 from CAPI.
+func IsNotFound(err error) bool {
+	var capiErr *Error
+	return errors.As(err, &capiErr) && capiErr.StatusCode == http.StatusNotFound
+}
+
+// IsForbidden reports whether err means that the token is invalid or isn't
+// allowed to do what was asked.
+func IsForbidden(err error) bool {
+	var capiErr *Error
+	return errors.As(err, &capiErr) && (capiErr.StatusCode == http.StatusUnauthorized || capiErr.StatusCode == http.StatusForbidden)
+}
+
+func parseError(response *http.Response) *Error {
+	capiErr := &Error{StatusCode: response.StatusCode, Host: response.Request.URL.Host}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	var v3Error struct {
+		Errors []ErrorDetail `json:"errors"`
+	}
+	if json.Unmarshal(body, &v3Error) == nil && len(v3Error.Errors) > 0 {
+		capiErr.Errors = v3Error.Errors
+	} else {
+		capiErr.Body = strings.TrimSpace(string(body))
+	}
+	return capiErr
+}
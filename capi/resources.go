@@ -0,0 +1,69 @@
+package capi
+
+// Relationship links a resource to another.
+type Relationship struct {
+	Data struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+type App struct {
+	GUID      string `json:"guid"`
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	Lifecycle struct {
+		Type string `json:"type"`
+		Data struct {
+			Stack      string   `json:"stack"`
+			Buildpacks []string `json:"buildpacks"`
+		} `json:"data"`
+	} `json:"lifecycle"`
+	Relationships struct {
+		Space Relationship `json:"space"`
+	} `json:"relationships"`
+}
+
+type Droplet struct {
+	GUID     string `json:"guid"`
+	State    string `json:"state"`
+	Stack    string `json:"stack"`
+	Checksum struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"checksum"`
+	ProcessTypes      map[string]string `json:"process_types"`
+	ExecutionMetadata string            `json:"execution_metadata"`
+}
+
+type Process struct {
+	GUID       string `json:"guid"`
+	Type       string `json:"type"`
+	Command    string `json:"command"`
+	Instances  int    `json:"instances"`
+	MemoryInMB int    `json:"memory_in_mb"`
+	DiskInMB   int    `json:"disk_in_mb"`
+}
+
+type Package struct {
+	GUID  string `json:"guid"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+}
+
+type Space struct {
+	GUID          string `json:"guid"`
+	Name          string `json:"name"`
+	Relationships struct {
+		Organization Relationship `json:"organization"`
+	} `json:"relationships"`
+}
+
+type Role struct {
+	GUID          string `json:"guid"`
+	Type          string `json:"type"`
+	Relationships struct {
+		User         Relationship `json:"user"`
+		Space        Relationship `json:"space"`
+		Organization Relationship `json:"organization"`
+	} `json:"relationships"`
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// httpClient is used for every outgoing request: to CAPI, to UAA, and to the
+// blobstores CAPI redirects droplet downloads to.
+var httpClient = &http.Client{CheckRedirect: checkRedirect}
+
+// clientTLSOptions configure how the servers the registry talks to are
+// verified, and how it identifies itself to them.
+type clientTLSOptions struct {
+	caCertPath     string
+	clientCertPath string
+	clientKeyPath  string
+	skipVerify     bool
+}
+
+func newHTTPClient(opts clientTLSOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.skipVerify}
+
+	if opts.caCertPath != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		caCerts, err := ioutil.ReadFile(opts.caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificates: %s", err)
+		}
+		if !rootCAs.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("no PEM certificates in %s", opts.caCertPath)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if (opts.clientCertPath == "") != (opts.clientKeyPath == "") {
+		return nil, errors.New("a client certificate and its key must be given together")
+	}
+	if opts.clientCertPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(opts.clientCertPath, opts.clientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: verificationErrorTransport{transport}, CheckRedirect: checkRedirect}, nil
+}
+
+// checkRedirect never sends CAPI or UAA credentials to another host, such as
+// the blobstore CAPI redirects droplet downloads to, whose signed URLs need
+// no credentials and which must not be able to act on the registry's behalf.
+func checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if request.URL.Host != via[0].URL.Host {
+		request.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// verificationErrorTransport explains certificate verification failures,
+// which otherwise leave operators guessing which option to set.
+type verificationErrorTransport struct {
+	http.RoundTripper
+}
+
+func (t verificationErrorTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.RoundTripper.RoundTrip(request)
+	if err == nil {
+		return response, nil
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return nil, fmt.Errorf("verifying TLS certificate of %s: %w (set --ca-cert to a bundle containing its CA)", request.URL.Host, err)
+	case errors.As(err, &hostname):
+		return nil, fmt.Errorf("verifying TLS certificate of %s: %w (the certificate is for a different host)", request.URL.Host, err)
+	case errors.As(err, &invalid):
+		return nil, fmt.Errorf("verifying TLS certificate of %s: %w", request.URL.Host, err)
+	}
+	return nil, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCATestServer serves TLS with a certificate for 127.0.0.1 from ca,
+// requiring client certificates from clientCA if it is set.
+func newCATestServer(t *testing.T, ca, clientCA *testCA) *httptest.Server {
+	certPEM, keyPEM := ca.issue(t, "server")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCA != nil {
+		server.TLS.ClientCAs = clientCA.pool()
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPClientTrustsTheCABundle(t *testing.T) {
+	ca := newTestCA(t)
+	server := newCATestServer(t, ca, nil)
+	bundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestFile(t, bundlePath, ca.pem, time.Now())
+
+	withBundle, err := newHTTPClient(clientTLSOptions{caCertPath: bundlePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := withBundle.Get(server.URL)
+	if err != nil {
+		t.Fatalf("with the CA bundle: %s", err)
+	}
+	response.Body.Close()
+
+	withoutBundle, err := newHTTPClient(clientTLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withoutBundle.Get(server.URL); err == nil {
+		t.Error("trusted a server whose CA isn't in the bundle")
+	}
+}
+
+func TestHTTPClientExplainsVerificationErrors(t *testing.T) {
+	ca := newTestCA(t)
+	server := newCATestServer(t, ca, nil)
+	bundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestFile(t, bundlePath, ca.pem, time.Now())
+
+	withoutBundle, err := newHTTPClient(clientTLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = withoutBundle.Get(server.URL)
+	if err == nil || !strings.Contains(err.Error(), "verifying TLS certificate of 127.0.0.1") || !strings.Contains(err.Error(), "set --ca-cert to a bundle containing its CA") {
+		t.Errorf("unknown authority error is %v", err)
+	}
+
+	withBundle, err := newHTTPClient(clientTLSOptions{caCertPath: bundlePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = withBundle.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+	if err == nil || !strings.Contains(err.Error(), "the certificate is for a different host") {
+		t.Errorf("hostname error is %v", err)
+	}
+
+	if _, err := newHTTPClient(clientTLSOptions{caCertPath: filepath.Join(t.TempDir(), "missing.pem")}); err == nil || !strings.Contains(err.Error(), "reading CA certificates") {
+		t.Errorf("missing bundle error is %v", err)
+	}
+}
+
+func TestHTTPClientPresentsItsCertificate(t *testing.T) {
+	ca, clientCA := newTestCA(t), newTestCA(t)
+	server := newCATestServer(t, ca, clientCA)
+	dir := t.TempDir()
+	bundlePath, certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writeTestFile(t, bundlePath, ca.pem, time.Now())
+	certPEM, keyPEM := clientCA.issue(t, "registry")
+	writeTestFile(t, certPath, certPEM, time.Now())
+	writeTestFile(t, keyPath, keyPEM, time.Now())
+
+	anonymous, err := newHTTPClient(clientTLSOptions{caCertPath: bundlePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anonymous.Get(server.URL); err == nil {
+		t.Error("a server requiring client certificates served a client without one")
+	}
+
+	client, err := newHTTPClient(clientTLSOptions{caCertPath: bundlePath, clientCertPath: certPath, clientKeyPath: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("with a client certificate: %s", err)
+	}
+	response.Body.Close()
+
+	if _, err := newHTTPClient(clientTLSOptions{clientCertPath: certPath}); err == nil {
+		t.Error("accepted a client certificate without its key")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
+)
+
+// command is a subcommand of the registry's CLI. Every command takes the
+// configuration flags, and works on the store it configures.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(flags *flag.FlagSet, args []string)
+}
+
+var commands = []command{
+	{name: "serve", summary: "Serve the registry. This is the default command.", run: serveCommand},
+	{name: "import-rootfs", args: "[<stack> <rootfs path>]", summary: "Import the rootfs of a stack into the store, or those of the configured stacks, for the registry to serve from then on.", run: importRootfsCommand},
+	{name: "convert", args: "<droplet tarball> <name>[:<tag>]", summary: "Convert a droplet tarball, such as one saved by \"cf download-droplet\", into a tagged image in the store, without CAPI.", run: convertCommand},
+	{name: "export", args: "<image> <destination>", summary: "Write an app's image, or one made by convert, to an OCI image layout, an OCI tarball or a tarball for \"docker load\", from the blobs in the store.", run: exportCommand},
+	{name: "push", args: "<image> [http://]<registry host>/<repository>[:<tag>]", summary: "Push an app's image, or one made by convert, to another registry, uploading only the blobs it doesn't have.", run: pushCommand},
+	{name: "migrate-store", summary: "Move a store with the flat layout to the OCI image layout, which store.layout must be set to from then on. The registry mustn't be running on the store.", run: migrateStoreCommand},
+	{name: "gc", summary: "Remove blobs that nothing in the store refers to any more.", run: gcCommand},
+	{name: "fsck", summary: "Check the store for corrupt, missing or unreadable files.", run: fsckCommand},
+	{name: "config", args: "show", summary: "Print the configuration with secrets redacted, then check it.", run: configCommand},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: spikistry [<command>] [flags] [<args>]\n\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun `spikistry <command> -h` for a command's flags.")
+}
+
+func runCommand(name string, args []string) {
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		c := c
+		flags := flag.NewFlagSet("spikistry "+c.name, flag.ExitOnError)
+		flags.Usage = func() {
+			fmt.Fprintf(flags.Output(), "usage: spikistry %s [flags] %s\n\n%s\n\nflags:\n", c.name, c.args, c.summary)
+			flags.PrintDefaults()
+		}
+		c.run(flags, args)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// commandConfig loads the configuration of a command, exiting if it can't be,
+// or if the command was given the wrong number of arguments.
+func commandConfig(flags *flag.FlagSet, args []string, validArgs ...int) (*config, []string) {
+	cfg, args, err := loadConfig(flags, args, os.Getenv)
+	must("load config", err)
+
+	for _, n := range validArgs {
+		if len(args) == n {
+			return cfg, args
+		}
+	}
+	flags.Usage()
+	os.Exit(2)
+	return nil, nil
+}
+
+// openStore returns a storeManager for the configured store, exiting if the
+// store doesn't have the configured layout. It has no CAPI client, which only
+// serve needs.
+func openStore(cfg *config, logger *log.Logger) *storeManager {
+	store := newStoreManager(cfg, logger)
+	must("open store", store.prepare())
+	return store
+}
+
+func newStoreManager(cfg *config, logger *log.Logger) *storeManager {
+	return &storeManager{
+		path:                 cfg.Store.Path,
+		logger:               logger,
+		splitLayers:          cfg.Store.SplitLayers,
+		ociLayout:            cfg.Store.Layout == ociLayout,
+		maxDropletCacheBytes: cfg.Store.MaxDropletCacheBytes,
+		callerIdentity:       cfg.CAPI.UseCallerIdentity,
+	}
+}
+
+func offlineLogger() *log.Logger {
+	return log.New(os.Stderr, "[spikistry] ", log.LstdFlags)
+}
+
+func serveCommand(flags *flag.FlagSet, args []string) {
+	cfg, _ := commandConfig(flags, args, 0)
+	must("validate config", cfg.validate())
+	serve(cfg)
+}
+
+// importRootfsCommand imports rootfs into the store while the registry isn't
+// running. The registry loads them when it starts.
+func importRootfsCommand(flags *flag.FlagSet, args []string) {
+	cfg, args := commandConfig(flags, args, 0, 2)
+	must("validate config", cfg.validateStore())
+
+	stacks := cfg.Stacks
+	if len(args) == 2 {
+		stacks = map[string]string{args[0]: args[1]}
+	}
+	if len(stacks) == 0 {
+		must("import rootfs", fmt.Errorf("no stacks are configured, so a stack and a rootfs path must be given"))
+	}
+
+	var names []string
+	for stack := range stacks {
+		names = append(names, stack)
+	}
+	sort.Strings(names)
+	store := openStore(cfg, offlineLogger())
+	for _, stack := range names {
+		must("import rootfs", store.importRootfs(stack, stacks[stack]))
+	}
+}
+
+func convertCommand(flags *flag.FlagSet, args []string) {
+	metadataPath := flags.String("droplet-metadata", "", "JSON file with the droplet's stack, checksum and process types, in the shape CAPI reports droplets in, e.g. saved with \"cf curl /v3/droplets/<guid>\"")
+	stack := flags.String("stack", "", "stack the droplet was staged for, overriding its metadata's; "+defaultStack+" if neither is given")
+	processType := flags.String("process-type", "", "process type whose command becomes the image's Cmd; web if empty")
+	cfg, args := commandConfig(flags, args, 2)
+	must("validate config", cfg.validateStore())
+
+	var metadata capi.Droplet
+	if *metadataPath != "" {
+		must("read droplet metadata", readJSONFile(*metadataPath, &metadata))
+	}
+	if *stack != "" {
+		metadata.Stack = *stack
+	}
+	name, tag, err := parseImageReference(args[1])
+	must("convert droplet", err)
+
+	droplet, err := os.Open(args[0])
+	must("open droplet", err)
+	defer droplet.Close()
+	store := openStore(cfg, offlineLogger())
+	must("load stacks", store.loadStacks())
+	digest, err := store.ConvertDroplet(droplet, name+":"+tag, metadata, *processType)
+	must("convert droplet", err)
+	fmt.Printf("%s:%s@%s\n", name, tag, digest)
+}
+
+func exportCommand(flags *flag.FlagSet, args []string) {
+	format := flags.String("format", ociLayoutFormat, "\""+ociLayoutFormat+"\" for an OCI image layout directory, \""+ociArchiveFormat+"\" for a tarball of one, or \""+dockerArchiveFormat+"\" for a tarball for \"docker load\"; tarballs are written to stdout if the destination is -")
+	cfg, args := commandConfig(flags, args, 2)
+	must("validate config", cfg.validateStore())
+	store := openStore(cfg, offlineLogger())
+	ref, dest := args[0], args[1]
+
+	switch *format {
+	case ociLayoutFormat:
+		must("export image", store.ExportOCILayout(ref, dest))
+	case ociArchiveFormat, dockerArchiveFormat:
+		out := os.Stdout
+		if dest != "-" {
+			var err error
+			out, err = os.Create(dest)
+			must("create archive", err)
+		}
+		must("export image", store.ExportArchive(ref, *format, out))
+		must("close archive", out.Close())
+	default:
+		must("export image", fmt.Errorf("unknown format %q", *format))
+	}
+}
+
+func pushCommand(flags *flag.FlagSet, args []string) {
+	cfg, args := commandConfig(flags, args, 2)
+	must("validate config", cfg.validateStore())
+	store := openStore(cfg, offlineLogger())
+	must("load stacks", store.loadStacks())
+
+	report, err := store.PushImage(args[0], args[1], cfg.pushCredentials())
+	must("push image", err)
+	fmt.Printf("uploaded %d blobs, mounted %d, skipped %d the registry had\n", len(report.Uploaded), len(report.Mounted), len(report.Existing))
+	fmt.Printf("%s@%s\n", report.Destination, report.Digest)
+}
+
+func migrateStoreCommand(flags *flag.FlagSet, args []string) {
+	cfg, _ := commandConfig(flags, args, 0)
+	must("validate config", cfg.validateStore())
+
+	must("migrate store", newStoreManager(cfg, offlineLogger()).migrateToOCILayout())
+	if cfg.Store.Layout != ociLayout {
+		fmt.Printf("store %s has the %s layout now; set store.layout to %s to use it\n", cfg.Store.Path, ociLayout, ociLayout)
+	}
+}
+
+func gcCommand(flags *flag.FlagSet, args []string) {
+	gracePeriod := flags.Duration("grace-period", time.Hour, "leave files modified more recently than this, which may belong to an import or conversion in progress")
+	maxManifestAge := flags.Duration("max-manifest-age", 0, "forget manifests recorded for an app longer ago than this, other than its newest, so they can't be pulled by digest; don't if 0")
+	dryRun := flags.Bool("dry-run", false, "only print what would be removed")
+	cfg, _ := commandConfig(flags, args, 0)
+	must("validate config", cfg.validateStore())
+
+	report, err := openStore(cfg, offlineLogger()).gc(*gracePeriod, *maxManifestAge, *dryRun)
+	must("collect garbage", err)
+
+	forgot, removed := "forgot", "removed"
+	if *dryRun {
+		forgot, removed = "would forget", "would remove"
+	}
+	for _, manifest := range report.expiredManifests {
+		fmt.Printf("%s manifest %s\n", forgot, manifest)
+	}
+	for _, name := range report.removed {
+		fmt.Printf("%s %s\n", removed, name)
+	}
+	fmt.Printf("%s %d files, %d bytes\n", removed, len(report.removed), report.removedBytes)
+}
+
+func fsckCommand(flags *flag.FlagSet, args []string) {
+	cfg, _ := commandConfig(flags, args, 0)
+	must("validate config", cfg.validateStore())
+
+	problems, err := openStore(cfg, offlineLogger()).fsck()
+	must("check store", err)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problems found\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Println("no problems found")
+}
+
+// configCommand runs `config show`, which prints the configuration the
+// registry would run with.
+func configCommand(flags *flag.FlagSet, args []string) {
+	if len(args) == 0 || args[0] != "show" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg, _ := commandConfig(flags, args[1:], 0)
+	must("show config", cfg.show(os.Stdout))
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
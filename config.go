@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// config is everything the registry can be configured with. It is built from,
+// in increasing order of precedence, defaults, a JSON config file,
+// SPIKISTRY_* environment variables and command line flags.
+type config struct {
+	ListenAddress      string `json:"listen_address"`
+	AdminListenAddress string `json:"admin_listen_address"`
+
+	Store struct {
+		Path                 string `json:"path"`
+		Layout               string `json:"layout"`
+		SplitLayers          bool   `json:"split_layers"`
+		MaxDropletCacheBytes int64  `json:"max_droplet_cache_bytes"`
+	} `json:"store"`
+
+	// Stacks maps stack names to the rootfs imported for them.
+	Stacks map[string]string `json:"stacks"`
+
+	TLS struct {
+		Cert     string `json:"cert"`
+		Key      string `json:"key"`
+		ClientCA string `json:"client_ca"`
+	} `json:"tls"`
+
+	Blobs struct {
+		ListenAddress string `json:"listen_address"`
+		BaseURL       string `json:"base_url"`
+		URLSecret     string `json:"url_secret"`
+	} `json:"blobs"`
+
+	CAPI struct {
+		URL               string `json:"url"`
+		AuthToken         string `json:"auth_token"`
+		UseCallerIdentity bool   `json:"use_caller_identity"`
+	} `json:"capi"`
+
+	UAA struct {
+		URL          string `json:"url"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	} `json:"uaa"`
+
+	// Push is what images are pushed to other registries with.
+	Push struct {
+		Registry string `json:"registry"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"push"`
+
+	Auth struct {
+		TokenSecret string `json:"token_secret"`
+	} `json:"auth"`
+
+	// CFTLS is how CAPI, UAA and blobstores are connected to.
+	CFTLS struct {
+		CACert     string `json:"ca_cert"`
+		ClientCert string `json:"client_cert"`
+		ClientKey  string `json:"client_key"`
+		SkipVerify bool   `json:"skip_verify"`
+	} `json:"cf_tls"`
+}
+
+func defaultConfig() *config {
+	cfg := &config{Stacks: map[string]string{}}
+	cfg.Store.Layout = flatLayout
+	cfg.UAA.ClientID = "cf"
+	return cfg
+}
+
+// setting is a config value that can also be set with a flag or an
+// environment variable.
+type setting struct {
+	key    string // in the config file
+	flag   string
+	usage  string
+	value  interface{} // a *string, *bool or *int64 in the config
+	secret bool
+}
+
+// settings returns the settings of cfg, pointing into it.
+func (cfg *config) settings() []setting {
+	return []setting{
+		{key: "listen_address", flag: "listen-address", usage: "address to serve the registry API on", value: &cfg.ListenAddress},
+		{key: "admin_listen_address", flag: "admin-listen-address", usage: "address for the unauthenticated admin API; disabled if empty", value: &cfg.AdminListenAddress},
+		{key: "store.path", flag: "store", usage: "directory to keep blobs, droplets and records in", value: &cfg.Store.Path},
+		{key: "store.layout", flag: "store-layout", usage: "\"" + flatLayout + "\" to keep blobs at the top of the store, or \"" + ociLayout + "\" for an OCI image layout other tools can read; see migrate-store", value: &cfg.Store.Layout},
+		{key: "store.split_layers", flag: "split-layers", usage: "split droplets into deps, profile.d and app layers", value: &cfg.Store.SplitLayers},
+		{key: "store.max_droplet_cache_bytes", flag: "max-droplet-cache-bytes", usage: "total size of downloaded droplets to keep once converted; unlimited if 0", value: &cfg.Store.MaxDropletCacheBytes},
+		{key: "tls.cert", flag: "tls-cert", usage: "PEM certificate to serve the registry with; plain HTTP if empty", value: &cfg.TLS.Cert},
+		{key: "tls.key", flag: "tls-key", usage: "PEM key of --tls-cert", value: &cfg.TLS.Key},
+		{key: "tls.client_ca", flag: "tls-client-ca", usage: "PEM bundle of CAs to require client certificates from", value: &cfg.TLS.ClientCA},
+		{key: "blobs.listen_address", flag: "blob-listen-address", usage: "address to also serve blobs on by themselves, e.g. behind a CDN; requires --blob-base-url", value: &cfg.Blobs.ListenAddress},
+		{key: "blobs.base_url", flag: "blob-base-url", usage: "external URL blob requests are redirected to; the registry's own if empty", value: &cfg.Blobs.BaseURL},
+		{key: "blobs.url_secret", flag: "blob-url-secret", usage: "key to sign blob URLs with; random if empty", value: &cfg.Blobs.URLSecret, secret: true},
+		{key: "capi.url", flag: "capi-url", usage: "CAPI to look up apps and droplets with", value: &cfg.CAPI.URL},
+		{key: "capi.auth_token", flag: "capi-authtoken", usage: "token to make CAPI calls with, as printed by \"cf oauth-token\"", value: &cfg.CAPI.AuthToken, secret: true},
+		{key: "capi.use_caller_identity", flag: "capi-use-caller-identity", usage: "make CAPI calls with the pulling user's token instead of --capi-authtoken; requires --uaa-url", value: &cfg.CAPI.UseCallerIdentity},
+		{key: "uaa.url", flag: "uaa-url", usage: "UAA to authenticate registry users against; the registry is unauthenticated if empty", value: &cfg.UAA.URL},
+		{key: "uaa.client_id", flag: "uaa-client-id", usage: "UAA client used for users' password grants", value: &cfg.UAA.ClientID},
+		{key: "uaa.client_secret", flag: "uaa-client-secret", usage: "secret of --uaa-client-id", value: &cfg.UAA.ClientSecret, secret: true},
+		{key: "push.registry", flag: "push-registry", usage: "host of the registry --push-username and --push-password are for, e.g. registry.example.com; they are sent to no other", value: &cfg.Push.Registry},
+		{key: "push.username", flag: "push-username", usage: "username to push images to --push-registry as; anonymous if empty", value: &cfg.Push.Username},
+		{key: "push.password", flag: "push-password", usage: "password or token of --push-username", value: &cfg.Push.Password, secret: true},
+		{key: "auth.token_secret", flag: "auth-token-secret", usage: "key to sign registry tokens with; random if empty", value: &cfg.Auth.TokenSecret, secret: true},
+		{key: "cf_tls.ca_cert", flag: "ca-cert", usage: "PEM bundle of additional CAs to trust for CAPI, UAA and blobstores", value: &cfg.CFTLS.CACert},
+		{key: "cf_tls.client_cert", flag: "client-cert", usage: "PEM client certificate to present to CAPI, UAA and blobstores", value: &cfg.CFTLS.ClientCert},
+		{key: "cf_tls.client_key", flag: "client-key", usage: "PEM key of --client-cert", value: &cfg.CFTLS.ClientKey},
+		{key: "cf_tls.skip_verify", flag: "skip-tls-verify", usage: "don't verify the certificates of CAPI, UAA and blobstores (insecure)", value: &cfg.CFTLS.SkipVerify},
+	}
+}
+
+// env is the environment variable overriding a setting.
+func (s setting) env() string {
+	return "SPIKISTRY_" + strings.ToUpper(strings.Replace(s.flag, "-", "_", -1))
+}
+
+// sources names the other ways a setting can be set, for error messages.
+func (s setting) sources() string {
+	return fmt.Sprintf("--%s or %s", s.flag, s.env())
+}
+
+func (s setting) set(raw string) error {
+	switch value := s.value.(type) {
+	case *string:
+		*value = raw
+	case *bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", raw)
+		}
+		*value = parsed
+	case *int64:
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected a whole number, got %q", raw)
+		}
+		*value = parsed
+	}
+	return nil
+}
+
+// settingFlag records a flag's value, to be applied once the config file and
+// environment have been.
+type settingFlag struct {
+	setting
+	raw *string
+}
+
+func (f settingFlag) String() string {
+	if f.raw == nil {
+		return ""
+	}
+	return *f.raw
+}
+
+func (f settingFlag) Set(raw string) error {
+	*f.raw = raw
+	return nil
+}
+
+func (f settingFlag) IsBoolFlag() bool {
+	_, ok := f.value.(*bool)
+	return ok
+}
+
+const (
+	configEnv     = "SPIKISTRY_CONFIG"
+	rootfsPathEnv = "SPIKISTRY_ROOTFS_PATH"
+)
+
+// loadConfig parses command line arguments, reading the config file they or
+// the environment name, and returns the resulting configuration along with
+// any positional arguments. It doesn't validate it.
+func loadConfig(flags *flag.FlagSet, args []string, getenv func(string) string) (*config, []string, error) {
+	cfg := defaultConfig()
+	settings := cfg.settings()
+
+	configPath := flags.String("config", "", "JSON config file; also "+configEnv)
+	flagStacks := stackPaths{}
+	flags.Var(flagStacks, "rootfs-path", "rootfs for a stack, as <stack>=<path>; a bare path is used for "+defaultStack+" (repeatable); also "+rootfsPathEnv+", comma-separated")
+	rawFlags := map[string]*string{}
+	for _, s := range settings {
+		rawFlags[s.flag] = new(string)
+		flags.Var(settingFlag{setting: s, raw: rawFlags[s.flag]}, s.flag, s.usage+"; also "+s.env())
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configPath == "" {
+		*configPath = getenv(configEnv)
+	}
+	if *configPath != "" {
+		if err := cfg.readFile(*configPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if raw := getenv(s.env()); raw != "" {
+			if err := s.set(raw); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", s.env(), err)
+			}
+		}
+	}
+	if raw := getenv(rootfsPathEnv); raw != "" {
+		envStacks := stackPaths{}
+		for _, value := range strings.Split(raw, ",") {
+			if err := envStacks.Set(value); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", rootfsPathEnv, err)
+			}
+		}
+		cfg.mergeStacks(envStacks)
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		if value, ok := f.Value.(settingFlag); ok && flagErr == nil {
+			if err := value.set(*value.raw); err != nil {
+				flagErr = fmt.Errorf("--%s: %s", f.Name, err)
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, nil, flagErr
+	}
+	cfg.mergeStacks(flagStacks)
+
+	return cfg, flags.Args(), nil
+}
+
+func (cfg *config) readFile(configPath string) error {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return fmt.Errorf("reading config file: %s", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("config file %s: %s", configPath, err)
+	}
+	return nil
+}
+
+// mergeStacks sets the rootfs of stacks, leaving those of other stacks as
+// they were.
+func (cfg *config) mergeStacks(stacks stackPaths) {
+	for stack, rootfsPath := range stacks {
+		cfg.Stacks[stack] = rootfsPath
+	}
+}
+
+// validate returns an error describing everything wrong with the
+// configuration, or nil.
+func (cfg *config) validate() error {
+	var problems []string
+	settings := map[string]setting{}
+	for _, s := range cfg.settings() {
+		settings[s.key] = s
+	}
+	problem := func(key, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s (set with %s)", fmt.Sprintf(format, args...), settings[key].sources()))
+	}
+	requireFile := func(key, filePath string) {
+		if filePath == "" {
+			return
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			problem(key, "%s can't be read: %s", key, err)
+		}
+	}
+	requireURL := func(key, rawURL string) {
+		if rawURL == "" {
+			return
+		}
+		parsed, err := url.Parse(rawURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problem(key, "%s must be an http or https URL, got %q", key, rawURL)
+		}
+	}
+
+	if cfg.ListenAddress == "" {
+		problem("listen_address", "listen_address must be set")
+	}
+	if cfg.Store.Path == "" {
+		problem("store.path", "store.path must be set")
+	}
+	if cfg.Store.Layout != flatLayout && cfg.Store.Layout != ociLayout {
+		problem("store.layout", "store.layout must be %s or %s, got %q", flatLayout, ociLayout, cfg.Store.Layout)
+	}
+	if cfg.Store.MaxDropletCacheBytes < 0 {
+		problem("store.max_droplet_cache_bytes", "store.max_droplet_cache_bytes must not be negative")
+	}
+
+	var stacks []string
+	for stack := range cfg.Stacks {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	for _, stack := range stacks {
+		if stack == "" || cfg.Stacks[stack] == "" {
+			problems = append(problems, fmt.Sprintf("stacks need a name and a rootfs path, got %q: %q", stack, cfg.Stacks[stack]))
+		} else if _, err := os.Stat(cfg.Stacks[stack]); err != nil {
+			problems = append(problems, fmt.Sprintf("rootfs of stack %s can't be read: %s", stack, err))
+		}
+	}
+
+	if cfg.TLS.Cert == "" && cfg.TLS.Key != "" || cfg.TLS.Cert != "" && cfg.TLS.Key == "" {
+		problem("tls.key", "tls.cert and tls.key must be set together")
+	}
+	if cfg.TLS.ClientCA != "" && cfg.TLS.Cert == "" {
+		problem("tls.client_ca", "tls.client_ca requires tls.cert and tls.key")
+	}
+	requireFile("tls.cert", cfg.TLS.Cert)
+	requireFile("tls.key", cfg.TLS.Key)
+	requireFile("tls.client_ca", cfg.TLS.ClientCA)
+
+	if cfg.Blobs.ListenAddress != "" && cfg.Blobs.BaseURL == "" {
+		problem("blobs.base_url", "blobs.base_url must be set to use blobs.listen_address")
+	}
+	requireURL("blobs.base_url", cfg.Blobs.BaseURL)
+
+	if cfg.CAPI.URL == "" {
+		problem("capi.url", "capi.url must be set")
+	}
+	requireURL("capi.url", cfg.CAPI.URL)
+	if cfg.CAPI.AuthToken == "" && !cfg.CAPI.UseCallerIdentity {
+		problem("capi.auth_token", "capi.auth_token must be set unless capi.use_caller_identity is")
+	}
+	if cfg.CAPI.UseCallerIdentity && cfg.UAA.URL == "" {
+		problem("uaa.url", "uaa.url must be set to use capi.use_caller_identity")
+	}
+	requireURL("uaa.url", cfg.UAA.URL)
+
+	if cfg.Push.Username == "" && cfg.Push.Password != "" {
+		problem("push.username", "push.username must be set to use push.password")
+	}
+	if cfg.Push.Username != "" && cfg.Push.Registry == "" {
+		problem("push.registry", "push.registry must be set to use push.username")
+	}
+
+	if cfg.CFTLS.ClientCert == "" && cfg.CFTLS.ClientKey != "" || cfg.CFTLS.ClientCert != "" && cfg.CFTLS.ClientKey == "" {
+		problem("cf_tls.client_key", "cf_tls.client_cert and cf_tls.client_key must be set together")
+	}
+	requireFile("cf_tls.ca_cert", cfg.CFTLS.CACert)
+	requireFile("cf_tls.client_cert", cfg.CFTLS.ClientCert)
+	requireFile("cf_tls.client_key", cfg.CFTLS.ClientKey)
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// validateStore returns an error if the configuration doesn't say where the
+// store is and what layout it has, which is all that commands working on it
+// offline need.
+func (cfg *config) validateStore() error {
+	if cfg.Store.Path == "" {
+		return fmt.Errorf("invalid configuration: store.path must be set (set with --store or %s)", setting{flag: "store"}.env())
+	}
+	if cfg.Store.Layout != flatLayout && cfg.Store.Layout != ociLayout {
+		return fmt.Errorf("invalid configuration: store.layout must be %s or %s, got %q", flatLayout, ociLayout, cfg.Store.Layout)
+	}
+	return nil
+}
+
+// show writes the configuration as a config file, with secrets redacted.
+func (cfg *config) show(dest io.Writer) error {
+	redacted := *cfg
+	for _, s := range redacted.settings() {
+		if value, ok := s.value.(*string); ok && s.secret && *value != "" {
+			*value = "<redacted>"
+		}
+	}
+
+	encoder := json.NewEncoder(dest)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(redacted)
+}
+
+// pushCredentials returns the credentials to push images to push.registry
+// with.
+func (cfg *config) pushCredentials() registryCredentials {
+	return registryCredentials{host: cfg.Push.Registry, username: cfg.Push.Username, password: cfg.Push.Password}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testConfig(t *testing.T, file string, env map[string]string, args ...string) (*config, error) {
+	t.Helper()
+	if file != "" {
+		configPath := filepath.Join(t.TempDir(), "config.json")
+		if err := ioutil.WriteFile(configPath, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"--config", configPath}, args...)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	cfg, _, err := loadConfig(flags, args, func(name string) string { return env[name] })
+	return cfg, err
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := `{
+		"listen_address": "file:1",
+		"admin_listen_address": "file:2",
+		"store": {"path": "/file/store", "split_layers": true},
+		"stacks": {"cflinuxfs2": "/file/fs2", "cflinuxfs3": "/file/fs3"},
+		"capi": {"url": "https://file.example.com"}
+	}`
+	env := map[string]string{
+		"SPIKISTRY_ADMIN_LISTEN_ADDRESS": "env:2",
+		"SPIKISTRY_STORE":                "/env/store",
+		"SPIKISTRY_SPLIT_LAYERS":         "false",
+		"SPIKISTRY_ROOTFS_PATH":          "cflinuxfs3=/env/fs3",
+	}
+
+	cfg, err := testConfig(t, file, env, "--store", "/flag/store", "--rootfs-path", "/flag/fs2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, actual := range map[string][2]string{
+		"listen address":       {cfg.ListenAddress, "file:1"},
+		"admin listen address": {cfg.AdminListenAddress, "env:2"},
+		"store":                {cfg.Store.Path, "/flag/store"},
+		"cflinuxfs2":           {cfg.Stacks["cflinuxfs2"], "/flag/fs2"},
+		"cflinuxfs3":           {cfg.Stacks["cflinuxfs3"], "/env/fs3"},
+		"capi url":             {cfg.CAPI.URL, "https://file.example.com"},
+		"uaa client id":        {cfg.UAA.ClientID, "cf"},
+	} {
+		if actual[0] != actual[1] {
+			t.Errorf("%s is %q, expected %q", name, actual[0], actual[1])
+		}
+	}
+	if cfg.Store.SplitLayers {
+		t.Errorf("environment didn't override split_layers")
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		file string
+		env  map[string]string
+		args []string
+	}{
+		"unknown field":        {file: `{"listen_addresss": ":8080"}`},
+		"wrong type":           {file: `{"store": {"split_layers": "yes"}}`},
+		"invalid env bool":     {env: map[string]string{"SPIKISTRY_SPLIT_LAYERS": "maybe"}},
+		"invalid env number":   {env: map[string]string{"SPIKISTRY_MAX_DROPLET_CACHE_BYTES": "1GB"}},
+		"invalid flag number":  {args: []string{"--max-droplet-cache-bytes", "lots"}},
+		"invalid env stack":    {env: map[string]string{"SPIKISTRY_ROOTFS_PATH": "cflinuxfs2="}},
+		"missing config file":  {env: map[string]string{"SPIKISTRY_CONFIG": "/does/not/exist.json"}},
+		"unknown command flag": {args: []string{"--listen"}},
+	} {
+		if _, err := testConfig(t, test.file, test.env, test.args...); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	rootfs := t.TempDir()
+	cfg, err := testConfig(t, "", nil,
+		"--store", t.TempDir(),
+		"--rootfs-path", rootfs,
+		"--capi-url", "https://api.example.com",
+		"--capi-authtoken", "bearer some-token",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "listen_address must be set (set with --listen-address or SPIKISTRY_LISTEN_ADDRESS)") {
+		t.Fatalf("expected listen_address to be required, got %v", err)
+	}
+
+	cfg.ListenAddress = ":8080"
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("expected a valid config, got %s", err)
+	}
+
+	cfg.CAPI.URL = "api.example.com"
+	cfg.CAPI.UseCallerIdentity = true
+	cfg.TLS.Key = "/does/not/exist"
+	cfg.Stacks["cflinuxfs3"] = "/does/not/exist"
+	err = cfg.validate()
+	if err == nil {
+		t.Fatal("expected an invalid config")
+	}
+	for _, problem := range []string{
+		`capi.url must be an http or https URL, got "api.example.com"`,
+		"uaa.url must be set to use capi.use_caller_identity",
+		"tls.cert and tls.key must be set together",
+		"tls.key can't be read",
+		"rootfs of stack cflinuxfs3 can't be read",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q in:\n%s", problem, err)
+		}
+	}
+}
+
+func TestConfigShowRedactsSecrets(t *testing.T) {
+	cfg, err := testConfig(t, `{"uaa": {"client_secret": "uaa-secret"}}`, map[string]string{"SPIKISTRY_CAPI_AUTHTOKEN": "bearer capi-secret"}, "--auth-token-secret", "token-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var shown bytes.Buffer
+	if err := cfg.show(&shown); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"uaa-secret", "capi-secret", "token-secret"} {
+		if strings.Contains(shown.String(), secret) {
+			t.Errorf("config show revealed %s", secret)
+		}
+	}
+	if !strings.Contains(shown.String(), `"auth_token": "<redacted>"`) || !strings.Contains(shown.String(), `"url_secret": ""`) {
+		t.Errorf("expected set secrets to be redacted and unset ones empty, got:\n%s", shown.String())
+	}
+	if cfg.UAA.ClientSecret != "uaa-secret" {
+		t.Errorf("showing the config redacted the config itself")
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masters-of-cats/droplet-registry-spike/fakecf"
+)
+
+// These tests follow the pull workflow of the OCI distribution-spec
+// conformance suite, adapted to a registry whose repositories are app guids,
+// where any tag means whatever the app currently runs.
+
+// conformanceClient makes single requests, without following redirects, so
+// that each step of the workflow can be checked.
+type conformanceClient struct {
+	t        *testing.T
+	registry string
+}
+
+func newConformanceClient(t *testing.T, registry *testRegistry) *conformanceClient {
+	return &conformanceClient{t: t, registry: registry.URL}
+}
+
+func (c *conformanceClient) do(method, path string, header http.Header) (*http.Response, []byte) {
+	request, err := http.NewRequest(method, c.registry+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := noRedirects.Do(request)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return response, body
+}
+
+func (c *conformanceClient) expectStatus(response *http.Response, status int) {
+	c.t.Helper()
+	if response.StatusCode != status {
+		c.t.Fatalf("%s %s: expected status %d, got %s", response.Request.Method, response.Request.URL.Path, status, response.Status)
+	}
+}
+
+// expectError checks that a response carries exactly one error with code, in
+// the format of the spec.
+func (c *conformanceClient) expectError(response *http.Response, body []byte, status int, code string) {
+	c.t.Helper()
+	c.expectStatus(response, status)
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		c.t.Errorf("error has content type %q", contentType)
+	}
+	var errs registryErrors
+	if err := json.Unmarshal(body, &errs); err != nil {
+		c.t.Fatalf("error body %q is not JSON: %s", body, err)
+	}
+	if len(errs.Errors) != 1 || errs.Errors[0].Code != code || errs.Errors[0].Message == "" {
+		c.t.Errorf("expected a %s error with a message, got %+v", code, errs.Errors)
+	}
+}
+
+func expectDigest(t *testing.T, response *http.Response, body []byte) string {
+	t.Helper()
+	checksum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(checksum[:])
+	if header := response.Header.Get("Docker-Content-Digest"); header != digest {
+		t.Errorf("Docker-Content-Digest is %q, content has digest %s", header, digest)
+	}
+	return digest
+}
+
+func TestConformanceBaseCheck(t *testing.T) {
+	client := newConformanceClient(t, newTestRegistry(t, false, false))
+
+	for _, method := range []string{"GET", "HEAD"} {
+		response, _ := client.do(method, "/v2/", nil)
+		client.expectStatus(response, http.StatusOK)
+		if version := response.Header.Get("Docker-Distribution-API-Version"); version != "registry/2.0" {
+			t.Errorf("%s /v2/ has API version %q", method, version)
+		}
+	}
+}
+
+func TestConformanceBaseCheckRequiresAuth(t *testing.T) {
+	client := newConformanceClient(t, newTestRegistry(t, true, false))
+
+	response, body := client.do("GET", "/v2/", nil)
+	client.expectError(response, body, http.StatusUnauthorized, errCodeUnauthorized)
+	if challenge := response.Header.Get("WWW-Authenticate"); !strings.HasPrefix(challenge, `Bearer realm="`) {
+		t.Errorf("expected a bearer challenge, got %q", challenge)
+	}
+	if version := response.Header.Get("Docker-Distribution-API-Version"); version != "registry/2.0" {
+		t.Errorf("unauthorized /v2/ has API version %q", version)
+	}
+}
+
+func TestConformanceManifestByTag(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := newConformanceClient(t, registry)
+	accept := http.Header{"Accept": {manifestMediaType}}
+
+	response, body := client.do("GET", "/v2/"+appGUID+"/manifests/latest", accept)
+	client.expectStatus(response, http.StatusOK)
+	digest := expectDigest(t, response, body)
+	if length := response.Header.Get("Content-Length"); length != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length is %q for %d bytes", length, len(body))
+	}
+
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.SchemaVersion != 2 || m.MediaType != manifestMediaType {
+		t.Errorf("manifest has schema version %d and media type %q", m.SchemaVersion, m.MediaType)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != m.MediaType {
+		t.Errorf("manifest is served as %q but has media type %q", contentType, m.MediaType)
+	}
+
+	response, headBody := client.do("HEAD", "/v2/"+appGUID+"/manifests/latest", accept)
+	client.expectStatus(response, http.StatusOK)
+	if len(headBody) != 0 {
+		t.Errorf("HEAD returned a body")
+	}
+	if header := response.Header.Get("Docker-Content-Digest"); header != digest {
+		t.Errorf("HEAD has digest %q, GET had %s", header, digest)
+	}
+	if length := response.Header.Get("Content-Length"); length != strconv.Itoa(len(body)) {
+		t.Errorf("HEAD has Content-Length %q, GET returned %d bytes", length, len(body))
+	}
+}
+
+func TestConformanceManifestContentNegotiation(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := newConformanceClient(t, registry)
+
+	for _, accept := range [][]string{
+		nil,
+		{"*/*"},
+		{"application/vnd.oci.image.manifest.v1+json", manifestMediaType},
+		{"application/vnd.oci.image.index.v1+json, " + manifestMediaType + "; q=0.9"},
+	} {
+		response, _ := client.do("GET", "/v2/"+appGUID+"/manifests/latest", http.Header{"Accept": accept})
+		client.expectStatus(response, http.StatusOK)
+		if contentType := response.Header.Get("Content-Type"); contentType != manifestMediaType {
+			t.Errorf("Accept %q got content type %q", accept, contentType)
+		}
+	}
+
+	response, body := client.do("GET", "/v2/"+appGUID+"/manifests/latest", http.Header{"Accept": {"application/vnd.oci.image.index.v1+json"}})
+	client.expectError(response, body, http.StatusNotFound, errCodeManifestUnknown)
+}
+
+func TestConformanceManifestOfUnknownRepository(t *testing.T) {
+	client := newConformanceClient(t, newTestRegistry(t, false, false))
+
+	response, body := client.do("GET", "/v2/unknown-app/manifests/latest", nil)
+	client.expectError(response, body, http.StatusNotFound, errCodeNameUnknown)
+
+	response, body = client.do("HEAD", "/v2/unknown-app/manifests/latest", nil)
+	client.expectStatus(response, http.StatusNotFound)
+	if len(body) != 0 {
+		t.Errorf("HEAD returned a body")
+	}
+}
+
+func TestConformanceManifestOfUnknownStack(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	droplet := someAppDroplet
+	droplet.Stack = "unknown-stack"
+	appGUID := registry.pushApp(t, droplet)
+	client := newConformanceClient(t, registry)
+
+	response, body := client.do("GET", "/v2/"+appGUID+"/manifests/latest", nil)
+	client.expectError(response, body, http.StatusNotFound, errCodeManifestUnknown)
+}
+
+func TestConformanceManifestRequiresPullAccess(t *testing.T) {
+	registry := newTestRegistry(t, true, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := newConformanceClient(t, registry)
+
+	response, body := client.do("GET", "/v2/"+appGUID+"/manifests/latest", nil)
+	client.expectError(response, body, http.StatusUnauthorized, errCodeUnauthorized)
+	if challenge := response.Header.Get("WWW-Authenticate"); !strings.Contains(challenge, `scope="repository:`+appGUID+`:pull"`) {
+		t.Errorf("challenge %q doesn't ask for the repository's pull scope", challenge)
+	}
+}
+
+func TestConformanceBlobs(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := newConformanceClient(t, registry)
+
+	response, body := client.do("GET", "/v2/"+appGUID+"/manifests/latest", nil)
+	client.expectStatus(response, http.StatusOK)
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, desc := range append([]descriptor{m.Config}, m.Layers...) {
+		for _, method := range []string{"GET", "HEAD"} {
+			// blobs may be served by another location, so clients have to
+			// follow redirects
+			response, _ := client.do(method, "/v2/"+appGUID+"/blobs/"+desc.Digest, nil)
+			client.expectStatus(response, http.StatusTemporaryRedirect)
+			location, err := response.Location()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, body := client.do(method, location.RequestURI(), nil)
+			client.expectStatus(response, http.StatusOK)
+			if length := response.Header.Get("Content-Length"); length != strconv.FormatInt(desc.Size, 10) {
+				t.Errorf("%s %s has Content-Length %q, manifest says %d", method, desc.Digest, length, desc.Size)
+			}
+			if method == "HEAD" {
+				if len(body) != 0 {
+					t.Errorf("HEAD returned a body")
+				}
+				if header := response.Header.Get("Docker-Content-Digest"); header != desc.Digest {
+					t.Errorf("HEAD %s has digest %q", desc.Digest, header)
+				}
+				continue
+			}
+			if digest := expectDigest(t, response, body); digest != desc.Digest {
+				t.Errorf("blob %s has digest %s", desc.Digest, digest)
+			}
+		}
+	}
+}
+
+func TestConformanceBlobRange(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := newConformanceClient(t, registry)
+
+	response, body := client.do("GET", "/v2/"+appGUID+"/manifests/latest", nil)
+	client.expectStatus(response, http.StatusOK)
+	var m manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	response, _ = client.do("GET", "/v2/"+appGUID+"/blobs/"+m.Config.Digest, nil)
+	client.expectStatus(response, http.StatusTemporaryRedirect)
+	location, err := response.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, whole := client.do("GET", location.RequestURI(), nil)
+	client.expectStatus(response, http.StatusOK)
+	response, part := client.do("GET", location.RequestURI(), http.Header{"Range": {"bytes=0-9"}})
+	client.expectStatus(response, http.StatusPartialContent)
+	if string(part) != string(whole[:10]) {
+		t.Errorf("range returned %q, expected %q", part, whole[:10])
+	}
+}
+
+func TestConformanceManifestByDigest(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := newConformanceClient(t, registry)
+
+	response, byTag := client.do("GET", "/v2/"+appGUID+"/manifests/latest", nil)
+	client.expectStatus(response, http.StatusOK)
+	digest := expectDigest(t, response, byTag)
+
+	response, byDigest := client.do("GET", "/v2/"+appGUID+"/manifests/"+digest, nil)
+	client.expectStatus(response, http.StatusOK)
+	expectDigest(t, response, byDigest)
+	if contentType := response.Header.Get("Content-Type"); contentType != manifestMediaType {
+		t.Errorf("manifest by digest has content type %q", contentType)
+	}
+
+	response, body := client.do("HEAD", "/v2/"+appGUID+"/manifests/"+digest, nil)
+	client.expectStatus(response, http.StatusOK)
+	if len(body) != 0 || response.Header.Get("Docker-Content-Digest") != digest {
+		t.Errorf("HEAD by digest returned a body or the wrong digest")
+	}
+
+	// pinned images can still be pulled once the app has been restaged
+	restaged := fakecf.Droplet{Stack: defaultStack, Files: []fakecf.File{{Name: "app/server.rb", Contents: "puts 'hello again'"}}}
+	if err := registry.cf.Stage(appGUID, restaged); err != nil {
+		t.Fatal(err)
+	}
+	response, byTag = client.do("GET", "/v2/"+appGUID+"/manifests/latest", nil)
+	client.expectStatus(response, http.StatusOK)
+	if expectDigest(t, response, byTag) == digest {
+		t.Fatal("restaging didn't change the manifest")
+	}
+	response, body = client.do("GET", "/v2/"+appGUID+"/manifests/"+digest, nil)
+	client.expectStatus(response, http.StatusOK)
+	if string(body) != string(byDigest) {
+		t.Errorf("manifest by digest changed after restaging")
+	}
+}
+
+func TestConformanceManifestByUnknownDigest(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	otherAppGUID := registry.pushApp(t, fakecf.Droplet{Stack: defaultStack, Files: []fakecf.File{{Name: "other", Contents: "other"}}})
+	client := newConformanceClient(t, registry)
+
+	response, body := client.do("GET", "/v2/"+otherAppGUID+"/manifests/latest", nil)
+	client.expectStatus(response, http.StatusOK)
+	otherDigest := expectDigest(t, response, body)
+
+	for _, reference := range []string{
+		"sha256:" + strings.Repeat("0", 64),
+		otherDigest, // manifests are only found in the repository they were served for
+		"sha256:not-hex",
+		"sha512:" + strings.Repeat("0", 128),
+	} {
+		response, body := client.do("GET", "/v2/"+appGUID+"/manifests/"+reference, nil)
+		client.expectError(response, body, http.StatusNotFound, errCodeManifestUnknown)
+	}
+}
+
+func TestConformanceBlobErrors(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	otherAppGUID := registry.pushApp(t, fakecf.Droplet{Stack: defaultStack, Files: []fakecf.File{{Name: "other", Contents: "other"}}})
+	client := newConformanceClient(t, registry)
+
+	response, _ := client.do("GET", "/v2/"+appGUID+"/manifests/latest", nil)
+	client.expectStatus(response, http.StatusOK)
+	response, body := client.do("GET", "/v2/"+otherAppGUID+"/manifests/latest", nil)
+	client.expectStatus(response, http.StatusOK)
+	var other manifest
+	if err := json.Unmarshal(body, &other); err != nil {
+		t.Fatal(err)
+	}
+	otherAppLayer := other.Layers[len(other.Layers)-1].Digest
+
+	for _, digest := range []string{
+		"sha256:" + strings.Repeat("0", 64),
+		otherAppLayer, // blobs are only found in the repositories whose manifests use them
+	} {
+		response, body := client.do("GET", "/v2/"+appGUID+"/blobs/"+digest, nil)
+		client.expectError(response, body, http.StatusNotFound, errCodeBlobUnknown)
+	}
+	response, body = client.do("GET", registry.blobURLs.url("sha256:"+strings.Repeat("0", 64), time.Now()), nil)
+	client.expectError(response, body, http.StatusNotFound, errCodeBlobUnknown)
+
+	for _, digest := range []string{
+		"no-algorithm",
+		"sha256:..",
+		"sha256:" + strings.Repeat("A", 64),
+		"sha512:" + strings.Repeat("0", 128),
+	} {
+		response, body := client.do("GET", "/v2/"+appGUID+"/blobs/"+digest, nil)
+		client.expectError(response, body, http.StatusBadRequest, errCodeDigestInvalid)
+		response, body = client.do("GET", "/foreign-blobs/"+digest, nil)
+		client.expectError(response, body, http.StatusBadRequest, errCodeDigestInvalid)
+	}
+}
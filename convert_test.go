@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readImageConfig(t *testing.T, store *storeManager, desc descriptor) imageConfig {
+	var config imageConfig
+	if err := readJSONFile(store.blobPath(strings.TrimPrefix(desc.Digest, "sha256:")), &config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func readStoredManifest(t *testing.T, store *storeManager, digest string) manifest {
+	var m manifest
+	if err := readJSONFile(store.blobPath(strings.TrimPrefix(digest, "sha256:")), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestConvertDropletReusesAppConversion(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	pulled := (&dockerClient{t: t, registry: registry.URL}).pull(appGUID)
+
+	// Like `cf curl /v3/apps/<guid>/droplets/current` and `cf download-droplet`.
+	metadata, err := registry.store.capi.CurrentDroplet(appGUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	droplet, err := registry.store.capi.DownloadDroplet(metadata.GUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer droplet.Close()
+
+	digest, err := registry.store.ConvertDroplet(droplet, "some-image:v1", metadata, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted := readStoredManifest(t, registry.store, digest)
+	if !reflect.DeepEqual(converted.Layers, pulled.manifest.Layers) {
+		t.Errorf("converted layers %v, app's are %v", converted.Layers, pulled.manifest.Layers)
+	}
+	config := readImageConfig(t, registry.store, converted.Config)
+	if cmd := config.ContainerConfig.Cmd; !reflect.DeepEqual(cmd, []string{"/bin/bash", "-c", "ruby server.rb"}) {
+		t.Errorf("image has Cmd %q", cmd)
+	}
+	if workingDir := config.ContainerConfig.WorkingDir; workingDir != "/home/vcap/app" {
+		t.Errorf("image has WorkingDir %q", workingDir)
+	}
+
+	image, err := registry.store.image("some-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag := image.Tags["v1"]; tag.Manifest != digest || tag.Stack != defaultStack {
+		t.Errorf("v1 is tagged %+v", tag)
+	}
+
+	if _, err := registry.store.gc(0, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := registry.store.fsck(); err != nil || len(problems) != 0 {
+		t.Errorf("after gc, fsck found %v, %v", problems, err)
+	}
+}
+
+func TestConvertDropletChecksMetadata(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	tarball, err := someAppDroplet.Tarball()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := testDroplet("", "other contents")
+	if _, err := registry.store.ConvertDroplet(bytes.NewReader(tarball), "some-image", metadata, ""); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+	metadata = testDroplet("", string(tarball))
+	metadata.Stack = "cflinuxfs4"
+	if _, err := registry.store.ConvertDroplet(bytes.NewReader(tarball), "some-image", metadata, ""); err == nil || !strings.Contains(err.Error(), "cflinuxfs4") {
+		t.Errorf("expected an unknown stack, got %v", err)
+	}
+	if _, err := registry.store.ConvertDroplet(bytes.NewReader(tarball), "Some-Image", testDroplet("", string(tarball)), ""); err == nil {
+		t.Errorf("expected an invalid image name to be refused")
+	}
+	if _, err := registry.store.ConvertDroplet(bytes.NewReader(tarball), "some-image", testDroplet("", string(tarball)), "worker"); err == nil {
+		t.Errorf("expected a missing process type to be refused")
+	}
+}
+
+func TestAdminAPIConvertsUploadedDroplets(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	admin := httptest.NewServer(NewAdminAPI("127.0.0.1:0", registry.store, registryCredentials{}))
+	defer admin.Close()
+
+	tarball, err := someAppDroplet.Tarball()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(processType string) *http.Response {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		request, _ := form.CreateFormField("request")
+		json.NewEncoder(request).Encode(map[string]interface{}{
+			"metadata":     map[string]interface{}{"process_types": someAppDroplet.ProcessTypes},
+			"process_type": processType,
+		})
+		droplet, _ := form.CreateFormFile("droplet", "droplet.tgz")
+		droplet.Write(tarball)
+		form.Close()
+
+		httpRequest, err := http.NewRequest("PUT", admin.URL+"/admin/images/some-image/tags/v2", &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpRequest.Header.Set("Content-Type", form.FormDataContentType())
+		response, err := http.DefaultClient.Do(httpRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response := upload("worker")
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("converting with a missing process type responded %s", response.Status)
+	}
+
+	response = upload("web")
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		t.Fatalf("converting responded %s: %s", response.Status, body)
+	}
+	var converted imageResponse
+	if err := json.NewDecoder(response.Body).Decode(&converted); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(converted.Image, "some-image:") {
+		t.Errorf("converted into %s", converted.Image)
+	}
+	config := readImageConfig(t, registry.store, readStoredManifest(t, registry.store, converted.Digest).Config)
+	if len(config.ContainerConfig.Cmd) != 3 || config.ContainerConfig.Cmd[2] != "ruby server.rb" {
+		t.Errorf("image has Cmd %q", config.ContainerConfig.Cmd)
+	}
+
+	dropletPath := filepath.Join(t.TempDir(), "droplet.tgz")
+	if err := ioutil.WriteFile(dropletPath, tarball, 0600); err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest("PUT", admin.URL+"/admin/images/some-image/tags/v3", strings.NewReader(`{"droplet_path": "`+dropletPath+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("converting a droplet on the registry's host responded %s", response.Status)
+	}
+	image, err := registry.store.image("some-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Tags["v3"].Droplet != image.Tags["v2"].Droplet {
+		t.Errorf("uploading and naming the same droplet stored different droplets: %+v", image.Tags)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// digestHex returns the hex-encoded checksum of a sha256 digest, which is
+// what blobs are named after in the store.
+func digestHex(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" {
+		return "", fmt.Errorf("digest %q is not a sha256 digest", digest)
+	}
+	if decoded, err := hex.DecodeString(parts[1]); err != nil || len(decoded) != 32 || strings.ToLower(parts[1]) != parts[1] {
+		return "", fmt.Errorf("digest %q is not a valid sha256 digest", digest)
+	}
+	return parts[1], nil
+}
+
+// checksumOf returns the hex-encoded sha256 checksum of contents.
+func checksumOf(contents []byte) string {
+	checksum := sha256.Sum256(contents)
+	return hex.EncodeToString(checksum[:])
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// dropletRoot is where the Cloud Foundry runtime untars droplets.
+const dropletRoot = "/home/vcap"
+
+// dropletLayers are the layers a droplet is split into, ordered from the
+// least to the most frequently changing.
+var dropletLayers = []string{"deps", "profile.d", "app"}
+
+// dropletLayer returns which of dropletLayers a rewritten entry belongs in,
+// given the layers earlier entries were written to. Hardlinks go wherever
+// their target was written, since a layer can't link to a file in another
+// one, and that may not be the layer the target's name suggests if it is a
+// hardlink too.
+func dropletLayer(header *tar.Header, written map[string]string) string {
+	name := header.Name
+	if header.Typeflag == tar.TypeLink {
+		if layer, ok := written[header.Linkname]; ok {
+			return layer
+		}
+		name = header.Linkname
+	}
+
+	switch top := strings.SplitN(strings.TrimPrefix(name, dropletRoot+"/"), "/", 2)[0]; top {
+	case "deps", "profile.d":
+		return top
+	}
+	return "app"
+}
+
+// normaliseTimes clears entry timestamps, so that identical files produce
+// identical layers however many times the app is restaged.
+func normaliseTimes(header *tar.Header) {
+	header.ModTime = time.Unix(0, 0)
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	for _, key := range []string{"mtime", "atime", "ctime"} {
+		delete(header.PAXRecords, key)
+	}
+}
+
+// dropletRewriter anchors droplet tar entries at /home/vcap, refusing any
+// entry that would end up outside of it once the layer is extracted.
+type dropletRewriter struct {
+	uid, gid int
+	symlinks map[string]bool
+}
+
+func newDropletRewriter(uid, gid int) *dropletRewriter {
+	return &dropletRewriter{uid: uid, gid: gid, symlinks: map[string]bool{}}
+}
+
+func (r *dropletRewriter) rewrite(header *tar.Header) error {
+	name, err := r.anchor(header.Name)
+	if err != nil {
+		return err
+	}
+	if name == dropletRoot && header.Typeflag != tar.TypeDir {
+		return fmt.Errorf("entry %q would replace %s itself", header.Name, dropletRoot)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeFifo:
+	case tar.TypeSymlink:
+		// Symlink targets are resolved inside the container, where the
+		// droplet lives at /home/vcap exactly as it does on Diego, so
+		// absolute targets already mean the same thing and relative ones
+		// only need cleaning. Entries beneath a symlink are refused below,
+		// so a target can never redirect where later entries are written.
+		if header.Linkname == "" {
+			return fmt.Errorf("symlink %q has no target", header.Name)
+		}
+		header.Linkname = path.Clean(header.Linkname)
+		r.symlinks[name] = true
+	case tar.TypeLink:
+		// Hardlink targets name another entry in the same tarball, so they
+		// are anchored the same way entry names are.
+		linkname, err := r.anchor(header.Linkname)
+		if err != nil {
+			return fmt.Errorf("hardlink %q: %s", header.Name, err)
+		}
+		if linkname == dropletRoot {
+			return fmt.Errorf("hardlink %q links to %s itself", header.Name, dropletRoot)
+		}
+		header.Linkname = linkname
+		// A hardlink to a symlink is another symlink to the same target.
+		if r.symlinks[linkname] {
+			r.symlinks[name] = true
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		return fmt.Errorf("entry %q is a device node", header.Name)
+	default:
+		return fmt.Errorf("entry %q has unsupported type %q", header.Name, header.Typeflag)
+	}
+
+	header.Name = name
+	header.Uid, header.Gid = r.uid, r.gid
+	header.Uname, header.Gname = "vcap", "vcap"
+	return nil
+}
+
+// anchor converts a droplet-relative entry name to an absolute one under
+// /home/vcap.
+func (r *dropletRewriter) anchor(name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("entry %q is absolute", name)
+	}
+
+	anchored := path.Join(dropletRoot, name)
+	if anchored != dropletRoot && !strings.HasPrefix(anchored, dropletRoot+"/") {
+		return "", fmt.Errorf("entry %q escapes %s", name, dropletRoot)
+	}
+
+	for parent := path.Dir(anchored); parent != dropletRoot && parent != "/"; parent = path.Dir(parent) {
+		if r.symlinks[parent] {
+			return "", fmt.Errorf("entry %q is beneath symlink %q", name, parent)
+		}
+	}
+
+	return anchored, nil
+}
+
+func dirHeader(name string, uid, gid int) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		Uid:      uid,
+		Gid:      gid,
+		ModTime:  time.Unix(0, 0),
+	}
+}
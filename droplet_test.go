@@ -0,0 +1,235 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDropletRewriterAnchorsRelativeEntries(t *testing.T) {
+	rewriter := newDropletRewriter(2000, 2000)
+	entries := []struct {
+		header       tar.Header
+		name, target string
+	}{
+		{tar.Header{Name: "./", Typeflag: tar.TypeDir}, dropletRoot, ""},
+		{tar.Header{Name: "./app/", Typeflag: tar.TypeDir}, dropletRoot + "/app", ""},
+		{tar.Header{Name: "app/server.rb", Typeflag: tar.TypeReg}, dropletRoot + "/app/server.rb", ""},
+		{tar.Header{Name: "deps/0/bin/ruby", Typeflag: tar.TypeReg}, dropletRoot + "/deps/0/bin/ruby", ""},
+		{tar.Header{Name: "app/ruby", Typeflag: tar.TypeLink, Linkname: "./deps/0/bin/ruby"}, dropletRoot + "/app/ruby", dropletRoot + "/deps/0/bin/ruby"},
+		{tar.Header{Name: "app/vendor", Typeflag: tar.TypeSymlink, Linkname: "../deps/0/./vendor/"}, dropletRoot + "/app/vendor", "../deps/0/vendor"},
+		{tar.Header{Name: "app/tmp", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}, dropletRoot + "/app/tmp", "/tmp"},
+		{tar.Header{Name: "app/pipe", Typeflag: tar.TypeFifo}, dropletRoot + "/app/pipe", ""},
+		{tar.Header{Name: "app/../staging_info.yml", Typeflag: tar.TypeReg}, dropletRoot + "/staging_info.yml", ""},
+	}
+
+	for _, entry := range entries {
+		header := entry.header
+		header.Uid, header.Uname = 0, "root"
+		if err := rewriter.rewrite(&header); err != nil {
+			t.Errorf("%s: %s", entry.header.Name, err)
+			continue
+		}
+		if header.Name != entry.name || header.Linkname != entry.target {
+			t.Errorf("%s was rewritten to %s -> %q", entry.header.Name, header.Name, header.Linkname)
+		}
+		if header.Uid != 2000 || header.Gid != 2000 || header.Uname != "vcap" || header.Gname != "vcap" {
+			t.Errorf("%s is owned by %s (%d:%d)", entry.header.Name, header.Uname, header.Uid, header.Gid)
+		}
+	}
+}
+
+func TestDropletRewriterRefusesUnsafeEntries(t *testing.T) {
+	symlink := tar.Header{Name: "app/link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}
+	tests := []struct {
+		name    string
+		before  []tar.Header
+		header  tar.Header
+		problem string
+	}{
+		{name: "parent escape", header: tar.Header{Name: "../etc/passwd", Typeflag: tar.TypeReg}, problem: "escapes"},
+		{name: "nested escape", header: tar.Header{Name: "app/../../../etc/passwd", Typeflag: tar.TypeReg}, problem: "escapes"},
+		{name: "absolute name", header: tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg}, problem: "absolute"},
+		{name: "file beneath a symlink", before: []tar.Header{symlink}, header: tar.Header{Name: "app/link/passwd", Typeflag: tar.TypeReg}, problem: "beneath symlink"},
+		{name: "directory beneath a symlink", before: []tar.Header{symlink}, header: tar.Header{Name: "app/link/sub/", Typeflag: tar.TypeDir}, problem: "beneath symlink"},
+		{name: "hardlink escaping", header: tar.Header{Name: "app/passwd", Typeflag: tar.TypeLink, Linkname: "../../../etc/passwd"}, problem: "escapes"},
+		{name: "hardlink to an absolute path", header: tar.Header{Name: "app/passwd", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}, problem: "absolute"},
+		{name: "hardlink through a symlink", before: []tar.Header{symlink}, header: tar.Header{Name: "app/passwd", Typeflag: tar.TypeLink, Linkname: "app/link/passwd"}, problem: "beneath symlink"},
+		{name: "file beneath a hardlink to a symlink", before: []tar.Header{symlink, {Name: "app/alias", Typeflag: tar.TypeLink, Linkname: "app/link"}}, header: tar.Header{Name: "app/alias/passwd", Typeflag: tar.TypeReg}, problem: "beneath symlink"},
+		{name: "hardlink to the droplet root", header: tar.Header{Name: "app/root", Typeflag: tar.TypeLink, Linkname: "."}, problem: "itself"},
+		{name: "symlink without a target", header: tar.Header{Name: "app/link", Typeflag: tar.TypeSymlink}, problem: "no target"},
+		{name: "character device", header: tar.Header{Name: "app/tty", Typeflag: tar.TypeChar}, problem: "device node"},
+		{name: "block device", header: tar.Header{Name: "app/sda", Typeflag: tar.TypeBlock}, problem: "device node"},
+		{name: "unsupported type", header: tar.Header{Name: "app/sparse", Typeflag: tar.TypeGNUSparse}, problem: "unsupported type"},
+		{name: "file named empty", header: tar.Header{Name: "", Typeflag: tar.TypeReg}, problem: "itself"},
+		{name: "file named dot", header: tar.Header{Name: ".", Typeflag: tar.TypeReg}, problem: "itself"},
+		{name: "symlink named dot", header: tar.Header{Name: "./", Typeflag: tar.TypeSymlink, Linkname: "/"}, problem: "itself"},
+	}
+
+	for _, test := range tests {
+		rewriter := newDropletRewriter(2000, 2000)
+		for _, before := range test.before {
+			if err := rewriter.rewrite(&before); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		err := rewriter.rewrite(&test.header)
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: expected an error about %q, got %v", test.name, test.problem, err)
+		}
+	}
+}
+
+// writeDropletTarball writes a droplet whose entries were all modified at
+// modified, returning its path.
+func writeDropletTarball(t *testing.T, headers []tar.Header, contents map[string]string, modified time.Time) string {
+	dropletPath := filepath.Join(t.TempDir(), "droplet.tgz")
+	file, err := os.Create(dropletPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(zipWriter)
+	for _, header := range headers {
+		header.ModTime, header.Mode = modified, 0755
+		header.Size = int64(len(contents[header.Name]))
+		if err := tarWriter.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(contents[header.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dropletPath
+}
+
+// layerEntries returns the headers in a stored layer by name.
+func layerEntries(t *testing.T, store *storeManager, desc descriptor) map[string]*tar.Header {
+	file, err := os.Open(store.blobPath(strings.TrimPrefix(desc.Digest, "sha256:")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zipReader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]*tar.Header{}
+	tarReader := tar.NewReader(zipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[header.Name] = header
+	}
+}
+
+func TestSplitLayersOnlyChangeWithTheirContents(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	registry.store.splitLayers = true
+	headers := []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir},
+		{Name: "./deps/", Typeflag: tar.TypeDir},
+		{Name: "./deps/0/bin/ruby", Typeflag: tar.TypeReg},
+		{Name: "./profile.d/", Typeflag: tar.TypeDir},
+		{Name: "./profile.d/ruby.sh", Typeflag: tar.TypeReg},
+		{Name: "./app/", Typeflag: tar.TypeDir},
+		{Name: "./app/server.rb", Typeflag: tar.TypeReg},
+		{Name: "./app/ruby", Typeflag: tar.TypeLink, Linkname: "./deps/0/bin/ruby"},
+	}
+	contents := map[string]string{
+		"./deps/0/bin/ruby":   "#!/bin/ruby",
+		"./profile.d/ruby.sh": "export PATH=$HOME/deps/0/bin:$PATH",
+		"./app/server.rb":     "puts 'hello'",
+	}
+
+	convert := func(dropletPath string) []descriptor {
+		layers, _, err := registry.store.convertDroplet("droplet", dropletPath, registry.store.stackRootfs(defaultStack))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(layers) != len(dropletLayers) {
+			t.Fatalf("converted into %d layers, want %d", len(layers), len(dropletLayers))
+		}
+		return layers
+	}
+	first := convert(writeDropletTarball(t, headers, contents, time.Unix(1500000000, 0)))
+	restaged := convert(writeDropletTarball(t, headers, contents, time.Unix(1600000000, 0)))
+	contents["./app/server.rb"] = "puts 'hello again'"
+	changed := convert(writeDropletTarball(t, headers, contents, time.Unix(1700000000, 0)))
+
+	for i, name := range dropletLayers {
+		if restaged[i].Digest != first[i].Digest {
+			t.Errorf("%s layer changed when only mtimes did", name)
+		}
+		if name != "app" && changed[i].Digest != first[i].Digest {
+			t.Errorf("%s layer changed when only app/ did", name)
+		}
+	}
+	if changed[2].Digest == first[2].Digest {
+		t.Error("app layer didn't change with app/")
+	}
+
+	deps, app := layerEntries(t, registry.store, first[0]), layerEntries(t, registry.store, first[2])
+	link := deps[dropletRoot+"/app/ruby"]
+	if link == nil || link.Typeflag != tar.TypeLink || link.Linkname != dropletRoot+"/deps/0/bin/ruby" {
+		t.Errorf("deps layer has hardlink %+v", link)
+	}
+	if app[dropletRoot+"/app/ruby"] != nil {
+		t.Error("hardlink into deps/ is in the app layer")
+	}
+	if app[dropletRoot+"/app/server.rb"] == nil || deps[dropletRoot+"/deps/0/bin/ruby"] == nil {
+		t.Errorf("layers have the wrong entries: deps %v, app %v", deps, app)
+	}
+}
+
+func TestSplitLayersKeepHardlinkChainsTogether(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	registry.store.splitLayers = true
+	headers := []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir},
+		{Name: "./deps/0/bin/ruby", Typeflag: tar.TypeReg},
+		{Name: "./app/ruby", Typeflag: tar.TypeLink, Linkname: "./deps/0/bin/ruby"},
+		{Name: "./app/irb", Typeflag: tar.TypeLink, Linkname: "./app/ruby"},
+		{Name: "./app/server.rb", Typeflag: tar.TypeReg},
+		{Name: "./deps/0/server.rb", Typeflag: tar.TypeLink, Linkname: "./app/server.rb"},
+		{Name: "./profile.d/server.rb", Typeflag: tar.TypeLink, Linkname: "./deps/0/server.rb"},
+	}
+	contents := map[string]string{"./deps/0/bin/ruby": "#!/bin/ruby", "./app/server.rb": "puts 'hello'"}
+
+	layers, _, err := registry.store.convertDroplet("droplet", writeDropletTarball(t, headers, contents, time.Now()), registry.store.stackRootfs(defaultStack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 {
+		t.Fatalf("converted into %d layers, want deps and app", len(layers))
+	}
+	want := map[string][]string{
+		"deps": {"deps/0/bin/ruby", "app/ruby", "app/irb"},
+		"app":  {"app/server.rb", "deps/0/server.rb", "profile.d/server.rb"},
+	}
+	for i, name := range []string{"deps", "app"} {
+		entries := layerEntries(t, registry.store, layers[i])
+		for _, entry := range want[name] {
+			if entries[dropletRoot+"/"+entry] == nil {
+				t.Errorf("%s isn't in the %s layer with the file it links to", entry, name)
+			}
+		}
+	}
+}
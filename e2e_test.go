@@ -0,0 +1,441 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
+	"github.com/masters-of-cats/droplet-registry-spike/fakecf"
+)
+
+const testSpace = "some-space"
+
+var someAppDroplet = fakecf.Droplet{
+	Stack: defaultStack,
+	Files: []fakecf.File{
+		{Name: "app/"},
+		{Name: "app/server.rb", Contents: "puts 'hello'"},
+		{Name: "app/current", Linkname: "server.rb"},
+		{Name: "staging_info.yml", Contents: "{}"},
+	},
+	ProcessTypes: map[string]string{"web": "ruby server.rb"},
+}
+
+type testRegistry struct {
+	*httptest.Server
+	cf       *fakecf.Server
+	store    *storeManager
+	blobURLs *blobURLs
+}
+
+// newTestRegistry serves the registry API against a fake CF, with a rootfs
+// whose vcap user is 2000:2000. With withAuth, users log in with UAA, and with
+// callerIdentity, CAPI calls are made with their tokens.
+func newTestRegistry(t *testing.T, withAuth, callerIdentity bool) *testRegistry {
+	cf := fakecf.New()
+	t.Cleanup(cf.Close)
+
+	rootfsPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfsPath, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "root:x:0:0:root:/root:/bin/bash\nvcap:x:2000:2000::/home/vcap:/bin/bash\n"
+	if err := ioutil.WriteFile(filepath.Join(rootfsPath, "etc", "passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &storeManager{
+		path:           t.TempDir(),
+		capi:           &capi.Client{URL: cf.CAPI.URL, Token: fakecf.AdminToken, HTTPClient: httpClient},
+		logger:         log.New(ioutil.Discard, "", 0),
+		callerIdentity: callerIdentity,
+	}
+	if callerIdentity {
+		store.capi.Token = ""
+	}
+	if err := store.importRootfs(defaultStack, rootfsPath); err != nil {
+		t.Fatal(err)
+	}
+
+	var auth *tokenAuth
+	if withAuth {
+		uaa := &uaaClient{url: cf.UAA.URL, clientID: fakecf.ClientID, clientSecret: fakecf.ClientSecret}
+		auth = newTokenAuth(uaa, store, "", callerIdentity)
+	}
+	blobs := newBlobURLs("", "")
+	server := httptest.NewServer(NewAPI("127.0.0.1:0", store, auth, blobs))
+	t.Cleanup(server.Close)
+	return &testRegistry{Server: server, cf: cf, store: store, blobURLs: blobs}
+}
+
+func (r *testRegistry) pushApp(t *testing.T, droplet fakecf.Droplet) string {
+	appGUID, err := r.cf.PushApp("some-app", testSpace, droplet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return appGUID
+}
+
+// addUser adds a user with a role in the test space, or none if roleType is
+// empty.
+func (r *testRegistry) addUser(name, roleType string) string {
+	userGUID := r.cf.AddUser(name, name+"-password")
+	if roleType != "" {
+		r.cf.AddRole(userGUID, testSpace, roleType)
+	}
+	return userGUID
+}
+
+// dockerClient pulls images the way docker does: asking /v2/ how to
+// authenticate, getting a token for the repository if it has to, and then
+// getting the manifest and its blobs.
+type dockerClient struct {
+	t                  *testing.T
+	registry           string
+	username, password string
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// login returns a token to pull an app with, or the status of the token
+// endpoint if it refuses to issue one.
+func (c *dockerClient) login(appGUID string) (string, int) {
+	response, err := http.Get(c.registry + "/v2/")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		return "", http.StatusOK
+	}
+	if response.StatusCode != http.StatusUnauthorized {
+		c.t.Fatalf("/v2/ responded %s", response.Status)
+	}
+
+	challenge := map[string]string{}
+	for _, param := range challengeParam.FindAllStringSubmatch(response.Header.Get("WWW-Authenticate"), -1) {
+		challenge[param[1]] = param[2]
+	}
+	query := url.Values{"service": {challenge["service"]}, "scope": {"repository:" + appGUID + ":pull"}}
+	request, err := http.NewRequest("GET", challenge["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	request.SetBasicAuth(c.username, c.password)
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", response.StatusCode
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		c.t.Fatal(err)
+	}
+	return token.Token, http.StatusOK
+}
+
+func (c *dockerClient) get(appGUID, token, path string) *http.Response {
+	request, err := http.NewRequest("GET", c.registry+"/v2/"+appGUID+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	request.Header.Set("Accept", manifestMediaType)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return response
+}
+
+// getManifest returns the response to a manifest request, failing if a token
+// couldn't be had.
+func (c *dockerClient) getManifest(appGUID string) *http.Response {
+	token, status := c.login(appGUID)
+	if status != http.StatusOK {
+		c.t.Fatalf("token endpoint responded %d", status)
+	}
+	return c.get(appGUID, token, "/manifests/latest")
+}
+
+type tarEntry struct {
+	header   *tar.Header
+	contents string
+}
+
+type pulledImage struct {
+	manifest manifest
+	config   imageConfig
+	layers   []map[string]tarEntry
+}
+
+// pull pulls an app's image, checking every blob against its digest and the
+// layers against the config's diff IDs.
+func (c *dockerClient) pull(appGUID string) pulledImage {
+	token, status := c.login(appGUID)
+	if status != http.StatusOK {
+		c.t.Fatalf("token endpoint responded %d", status)
+	}
+
+	response := c.get(appGUID, token, "/manifests/latest")
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		c.t.Fatalf("manifest request responded %s: %s", response.Status, body)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != manifestMediaType {
+		c.t.Errorf("manifest has content type %q", contentType)
+	}
+
+	var image pulledImage
+	if err := json.NewDecoder(response.Body).Decode(&image.manifest); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := json.Unmarshal(c.getBlob(appGUID, token, image.manifest.Config), &image.config); err != nil {
+		c.t.Fatal(err)
+	}
+	if len(image.config.Rootfs.DiffIDs) != len(image.manifest.Layers) {
+		c.t.Fatalf("config has %d diff IDs for %d layers", len(image.config.Rootfs.DiffIDs), len(image.manifest.Layers))
+	}
+
+	for i, layer := range image.manifest.Layers {
+		zipReader, err := gzip.NewReader(bytes.NewReader(c.getBlob(appGUID, token, layer)))
+		if err != nil {
+			c.t.Fatalf("layer %s is not gzipped: %s", layer.Digest, err)
+		}
+		summer := sha256.New()
+		uncompressed := io.TeeReader(zipReader, summer)
+		tarReader := tar.NewReader(uncompressed)
+		entries := map[string]tarEntry{}
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				c.t.Fatalf("reading layer %s: %s", layer.Digest, err)
+			}
+			contents, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			entries[header.Name] = tarEntry{header: header, contents: string(contents)}
+		}
+		io.Copy(ioutil.Discard, uncompressed)
+
+		if diffID := "sha256:" + hex.EncodeToString(summer.Sum(nil)); diffID != image.config.Rootfs.DiffIDs[i] {
+			c.t.Errorf("layer %s has diff ID %s, config says %s", layer.Digest, diffID, image.config.Rootfs.DiffIDs[i])
+		}
+		image.layers = append(image.layers, entries)
+	}
+	return image
+}
+
+func (c *dockerClient) getBlob(appGUID, token string, desc descriptor) []byte {
+	response := c.get(appGUID, token, "/blobs/"+desc.Digest)
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		c.t.Fatalf("blob %s request responded %s", desc.Digest, response.Status)
+	}
+
+	blob, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	checksum := sha256.Sum256(blob)
+	if digest := "sha256:" + hex.EncodeToString(checksum[:]); digest != desc.Digest {
+		c.t.Errorf("blob %s has digest %s", desc.Digest, digest)
+	}
+	if int64(len(blob)) != desc.Size {
+		c.t.Errorf("blob %s has size %d, manifest says %d", desc.Digest, len(blob), desc.Size)
+	}
+	return blob
+}
+
+func TestPullApp(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := &dockerClient{t: t, registry: registry.URL}
+
+	image := client.pull(appGUID)
+	if len(image.layers) != 2 {
+		t.Fatalf("expected a rootfs and an app layer, got %d layers", len(image.layers))
+	}
+	if image.config.ContainerConfig.User != "vcap" {
+		t.Errorf("image runs as %q", image.config.ContainerConfig.User)
+	}
+	if passwd, ok := image.layers[0]["etc/passwd"]; !ok || passwd.contents == "" {
+		t.Errorf("rootfs layer has no /etc/passwd")
+	}
+
+	app := image.layers[1]
+	for _, dir := range []string{"/home", "/home/vcap"} {
+		if _, ok := app[dir]; !ok {
+			t.Errorf("app layer has no %s", dir)
+		}
+	}
+	server, ok := app["/home/vcap/app/server.rb"]
+	if !ok {
+		t.Fatalf("app layer has no server.rb, has %v", app)
+	}
+	if server.contents != "puts 'hello'" {
+		t.Errorf("server.rb contains %q", server.contents)
+	}
+	if server.header.Uid != 2000 || server.header.Gid != 2000 || app["/home/vcap"].header.Uid != 2000 {
+		t.Errorf("app files are not owned by vcap")
+	}
+	if current := app["/home/vcap/app/current"]; current.header == nil || current.header.Linkname != "server.rb" {
+		t.Errorf("symlink was not kept")
+	}
+
+	client.pull(appGUID)
+	if downloads := registry.cf.DropletDownloads(); downloads != 1 {
+		t.Errorf("droplet was downloaded %d times, expected once", downloads)
+	}
+}
+
+func TestPullPicksUpRestages(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := &dockerClient{t: t, registry: registry.URL}
+	before := client.pull(appGUID)
+
+	restaged := fakecf.Droplet{Stack: defaultStack, Files: []fakecf.File{{Name: "app/server.rb", Contents: "puts 'hello again'"}}}
+	if err := registry.cf.Stage(appGUID, restaged); err != nil {
+		t.Fatal(err)
+	}
+	after := client.pull(appGUID)
+
+	if after.manifest.Layers[0] != before.manifest.Layers[0] {
+		t.Errorf("rootfs layer changed")
+	}
+	if contents := after.layers[1]["/home/vcap/app/server.rb"].contents; contents != "puts 'hello again'" {
+		t.Errorf("server.rb contains %q after restaging", contents)
+	}
+}
+
+func TestPullUnknownApp(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	client := &dockerClient{t: t, registry: registry.URL}
+
+	response := client.getManifest("unknown-app")
+	assertRegistryError(t, response, http.StatusNotFound, errCodeNameUnknown)
+}
+
+func TestPullWithAuth(t *testing.T) {
+	registry := newTestRegistry(t, true, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	registry.addUser("developer", "space_developer")
+	registry.addUser("auditor", "space_auditor")
+	registry.addUser("stranger", "")
+
+	for _, user := range []string{"developer", "auditor"} {
+		client := &dockerClient{t: t, registry: registry.URL, username: user, password: user + "-password"}
+		client.pull(appGUID)
+	}
+
+	stranger := &dockerClient{t: t, registry: registry.URL, username: "stranger", password: "stranger-password"}
+	response := stranger.getManifest(appGUID)
+	assertRegistryError(t, response, http.StatusUnauthorized, errCodeDenied)
+
+	wrongPassword := &dockerClient{t: t, registry: registry.URL, username: "developer", password: "wrong"}
+	if _, status := wrongPassword.login(appGUID); status != http.StatusUnauthorized {
+		t.Errorf("token endpoint responded %d to a wrong password", status)
+	}
+}
+
+func TestPullWithUAATokenAsPassword(t *testing.T) {
+	registry := newTestRegistry(t, true, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	userGUID := registry.addUser("developer", "space_developer")
+
+	client := &dockerClient{t: t, registry: registry.URL, username: "developer", password: "bearer " + registry.cf.AccessToken(userGUID)}
+	client.pull(appGUID)
+}
+
+func TestPullWithAPasswordThatHasTwoDots(t *testing.T) {
+	registry := newTestRegistry(t, true, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	registry.cf.AddRole(registry.cf.AddUser("developer", "correct.horse.battery"), testSpace, "space_developer")
+
+	client := &dockerClient{t: t, registry: registry.URL, username: "developer", password: "correct.horse.battery"}
+	client.pull(appGUID)
+}
+
+func TestPullWithCallerIdentity(t *testing.T) {
+	registry := newTestRegistry(t, true, true)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	registry.addUser("developer", "space_developer")
+	registry.addUser("auditor", "space_auditor")
+
+	developer := &dockerClient{t: t, registry: registry.URL, username: "developer", password: "developer-password"}
+	developer.pull(appGUID)
+
+	// auditors may see the app, but CAPI doesn't let them download droplets,
+	// even once it has been converted
+	auditor := &dockerClient{t: t, registry: registry.URL, username: "auditor", password: "auditor-password"}
+	response := auditor.getManifest(appGUID)
+	assertRegistryError(t, response, http.StatusForbidden, errCodeDenied)
+}
+
+func TestTokensWithoutACAPITokenAreChallenged(t *testing.T) {
+	registry := newTestRegistry(t, false, true)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	auth := newTokenAuth(nil, registry.store, "", true)
+	server := httptest.NewServer(NewAPI("127.0.0.1:0", registry.store, auth, registry.blobURLs))
+	defer server.Close()
+
+	token, err := auth.sign(tokenClaims{
+		UserName:  "developer",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		Access:    []accessClaim{{Type: "repository", Name: appGUID, Actions: []string{"pull"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := (&dockerClient{t: t, registry: server.URL}).get(appGUID, token, "/manifests/latest")
+	if challenge := response.Header.Get("WWW-Authenticate"); !strings.HasPrefix(challenge, "Bearer realm=") || !strings.Contains(challenge, appGUID) {
+		t.Errorf("challenge is %q", challenge)
+	}
+	assertRegistryError(t, response, http.StatusUnauthorized, errCodeUnauthorized)
+}
+
+// assertRegistryError checks that a response is a registry error with a
+// status and code, closing its body.
+func assertRegistryError(t *testing.T, response *http.Response, status int, code string) {
+	t.Helper()
+	defer response.Body.Close()
+
+	if response.StatusCode != status {
+		t.Errorf("expected status %d, got %s", status, response.Status)
+	}
+	var body registryErrors
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatalf("response is not a registry error: %s", err)
+	}
+	if len(body.Errors) != 1 || body.Errors[0].Code != code {
+		t.Errorf("expected error code %s, got %+v", code, body.Errors)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes defined by the Docker Registry HTTP API V2.
+const (
+	errCodeUnknown         = "UNKNOWN"
+	errCodeManifestUnknown = "MANIFEST_UNKNOWN"
+	errCodeNameUnknown     = "NAME_UNKNOWN"
+	errCodeBlobUnknown     = "BLOB_UNKNOWN"
+	errCodeDigestInvalid   = "DIGEST_INVALID"
+	errCodeUnauthorized    = "UNAUTHORIZED"
+	errCodeDenied          = "DENIED"
+)
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type registryErrors struct {
+	Errors []registryError `json:"errors"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(registryErrors{Errors: []registryError{{Code: code, Message: message}}})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The formats images can be exported in.
+const (
+	ociLayoutFormat     = "oci"
+	ociArchiveFormat    = "oci-archive"
+	dockerArchiveFormat = "docker-archive"
+)
+
+const (
+	ociConfigMediaType = "application/vnd.oci.image.config.v1+json"
+	ociIndexMediaType  = "application/vnd.oci.image.index.v1+json"
+	ociRefNameKey      = "org.opencontainers.image.ref.name"
+)
+
+// storedImage is an image whose manifest and blobs are in the store.
+type storedImage struct {
+	name string
+	// tag is empty if the image was referred to by digest.
+	tag              string
+	manifestChecksum string
+	manifest         manifest
+}
+
+// resolveImage finds an image in the store. A reference is either the name of
+// an image converted by ConvertDroplet, with an optional tag, or an app guid,
+// meaning the manifest last served for the app. Either can be followed by
+// @<digest> instead, to pick any of their manifests.
+func (s *storeManager) resolveImage(ref string) (storedImage, error) {
+	nameAndTag, digest := ref, ""
+	if i := strings.Index(ref, "@"); i >= 0 {
+		nameAndTag, digest = ref[:i], ref[i+1:]
+	}
+	name, tag, err := parseImageReference(nameAndTag)
+	if err != nil {
+		return storedImage{}, err
+	}
+	local, err := s.image(name)
+	if err != nil {
+		return storedImage{}, err
+	}
+	app, err := s.appManifests(name)
+	if err != nil {
+		return storedImage{}, err
+	}
+
+	image := storedImage{name: name, tag: tag}
+	switch {
+	case digest != "":
+		image.tag = ""
+		image.manifestChecksum, err = digestHex(digest)
+		if err != nil {
+			return storedImage{}, err
+		}
+		_, found := app.Manifests[image.manifestChecksum]
+		for _, record := range local.Tags {
+			found = found || record.Manifest == digest
+		}
+		if !found {
+			return storedImage{}, fmt.Errorf("%s has no manifest %s in the store", name, digest)
+		}
+	case local.Tags[tag].Manifest != "":
+		image.manifestChecksum, err = digestHex(local.Tags[tag].Manifest)
+		if err != nil {
+			return storedImage{}, err
+		}
+	case tag == "latest" && len(app.Manifests) > 0:
+		image.manifestChecksum = app.newest()
+	default:
+		return storedImage{}, fmt.Errorf("there is no image %s:%s in the store, nor an app %s that has been pulled", name, tag, name)
+	}
+
+	if err := readJSONFile(s.blobPath(image.manifestChecksum), &image.manifest); err != nil {
+		return storedImage{}, fmt.Errorf("reading manifest sha256:%s: %s", image.manifestChecksum, err)
+	}
+	return image, nil
+}
+
+// ociDescriptor is a descriptor with the annotations OCI indexes use.
+type ociDescriptor struct {
+	descriptor
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest returns an image's manifest with OCI media types. The config
+// and layers are the same blobs.
+func ociManifest(m manifest) manifest {
+	oci := createManifest(m.Config, append([]descriptor{}, m.Layers...)...)
+	oci.MediaType = ociManifestMediaType
+	oci.Config.MediaType = ociConfigMediaType
+	for i, layer := range oci.Layers {
+		if layer.MediaType == uncompressedLayerMediaType {
+			oci.Layers[i].MediaType = ociUncompressedLayerMediaType
+		} else {
+			oci.Layers[i].MediaType = ociLayerMediaType
+		}
+	}
+	return oci
+}
+
+// exportFiles is where the files of an exported image are written: a
+// directory or a tarball.
+type exportFiles interface {
+	has(name string) bool
+	write(name string, size int64, contents io.Reader) error
+}
+
+type dirFiles string
+
+func (d dirFiles) has(name string) bool {
+	return fileExists(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d dirFiles) write(name string, size int64, contents io.Reader) error {
+	filePath := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(filePath + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := io.Copy(file, contents); err != nil {
+		return fmt.Errorf("writing %s: %s", name, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filePath)
+}
+
+// tarFiles writes files into a tarball, along with their parent directories
+// and only once each.
+type tarFiles struct {
+	*tar.Writer
+	written map[string]bool
+}
+
+func newTarFiles(dest io.Writer) *tarFiles {
+	return &tarFiles{Writer: tar.NewWriter(dest), written: map[string]bool{}}
+}
+
+func (t *tarFiles) has(name string) bool {
+	return t.written[name]
+}
+
+func (t *tarFiles) write(name string, size int64, contents io.Reader) error {
+	var dirs []string
+	for dir := filepath.ToSlash(filepath.Dir(name)); dir != "."; dir = filepath.ToSlash(filepath.Dir(dir)) {
+		dirs = append([]string{dir + "/"}, dirs...)
+	}
+	for _, dir := range dirs {
+		if t.written[dir] {
+			continue
+		}
+		if err := t.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Unix(0, 0)}); err != nil {
+			return err
+		}
+		t.written[dir] = true
+	}
+
+	header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: size, ModTime: time.Unix(0, 0)}
+	if err := t.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(t, contents); err != nil {
+		return fmt.Errorf("writing %s: %s", name, err)
+	}
+	t.written[name] = true
+	return nil
+}
+
+// writeBlob copies a blob from the store, unless it has been written already.
+func (s *storeManager) writeBlob(files exportFiles, name string, desc descriptor) error {
+	if files.has(name) {
+		return nil
+	}
+	checksum, err := digestHex(desc.Digest)
+	if err != nil {
+		return err
+	}
+	blob, err := s.OpenBlob(checksum)
+	if err != nil {
+		return fmt.Errorf("opening blob %s: %s", desc.Digest, err)
+	}
+	defer blob.Close()
+	info, err := blob.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != desc.Size {
+		return fmt.Errorf("blob %s has size %d in the store, but %d in its manifest", desc.Digest, info.Size(), desc.Size)
+	}
+	return files.write(name, desc.Size, blob)
+}
+
+func writeJSON(files exportFiles, name string, value interface{}) error {
+	contents, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return files.write(name, int64(len(contents)), bytes.NewReader(contents))
+}
+
+// writeOCILayout writes an image as an OCI image layout, adding it to those
+// in index. It is named after its tag in the index, replacing any image of
+// the same name.
+func (s *storeManager) writeOCILayout(image storedImage, files exportFiles, index ociIndex) error {
+	if err := writeJSON(files, "oci-layout", map[string]string{"imageLayoutVersion": "1.0.0"}); err != nil {
+		return err
+	}
+
+	oci := ociManifest(image.manifest)
+	for _, desc := range append([]descriptor{oci.Config}, oci.Layers...) {
+		if err := s.writeBlob(files, "blobs/sha256/"+strings.TrimPrefix(desc.Digest, "sha256:"), desc); err != nil {
+			return err
+		}
+	}
+	manifestJson, err := json.Marshal(oci)
+	if err != nil {
+		return err
+	}
+	manifestDesc := ociDescriptor{descriptor: descriptor{
+		MediaType: ociManifestMediaType,
+		Digest:    "sha256:" + checksumOf(manifestJson),
+		Size:      int64(len(manifestJson)),
+	}}
+	if err := files.write("blobs/sha256/"+checksumOf(manifestJson), manifestDesc.Size, bytes.NewReader(manifestJson)); err != nil {
+		return err
+	}
+
+	manifests := []ociDescriptor{}
+	for _, existing := range index.Manifests {
+		if image.tag == "" || existing.Annotations[ociRefNameKey] != image.tag {
+			manifests = append(manifests, existing)
+		}
+	}
+	if image.tag != "" {
+		manifestDesc.Annotations = map[string]string{ociRefNameKey: image.tag}
+	}
+	index.SchemaVersion, index.MediaType = 2, ociIndexMediaType
+	index.Manifests = append(manifests, manifestDesc)
+	return writeJSON(files, "index.json", index)
+}
+
+// ExportOCILayout writes an image to an OCI image layout directory, reusing
+// the blobs in the store. If the directory already is a layout, the image is
+// added to it.
+func (s *storeManager) ExportOCILayout(ref, dir string) error {
+	image, err := s.resolveImage(ref)
+	if err != nil {
+		return err
+	}
+
+	var index ociIndex
+	if err := readJSONFile(filepath.Join(dir, "index.json"), &index); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading existing OCI index: %s", err)
+	}
+	return s.writeOCILayout(image, dirFiles(dir), index)
+}
+
+// ExportArchive writes an image as a tarball of an OCI image layout, or as a
+// docker-archive that `docker load` accepts, reusing the blobs in the store.
+func (s *storeManager) ExportArchive(ref, format string, dest io.Writer) error {
+	image, err := s.resolveImage(ref)
+	if err != nil {
+		return err
+	}
+
+	files := newTarFiles(dest)
+	switch format {
+	case ociArchiveFormat:
+		err = s.writeOCILayout(image, files, ociIndex{})
+	case dockerArchiveFormat:
+		err = s.writeDockerArchive(image, files)
+	default:
+		err = fmt.Errorf("unknown archive format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	return files.Close()
+}
+
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// writeDockerArchive writes an image in the format of `docker save`. Layers
+// stay compressed, which `docker load` handles.
+func (s *storeManager) writeDockerArchive(image storedImage, files exportFiles) error {
+	configName := strings.TrimPrefix(image.manifest.Config.Digest, "sha256:") + ".json"
+	if err := s.writeBlob(files, configName, image.manifest.Config); err != nil {
+		return err
+	}
+
+	archiveManifest := dockerArchiveManifest{Config: configName}
+	if image.tag != "" {
+		archiveManifest.RepoTags = []string{image.name + ":" + image.tag}
+	}
+	for _, layer := range image.manifest.Layers {
+		layerName := strings.TrimPrefix(layer.Digest, "sha256:") + ".tar"
+		if layer.MediaType != uncompressedLayerMediaType {
+			layerName += ".gz"
+		}
+		if err := s.writeBlob(files, layerName, layer); err != nil {
+			return err
+		}
+		archiveManifest.Layers = append(archiveManifest.Layers, layerName)
+	}
+	return writeJSON(files, "manifest.json", []dockerArchiveManifest{archiveManifest})
+}
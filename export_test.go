@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// reimport imports an exported image as the rootfs of a new store, which
+// checks its layers against their digests and its config's diff IDs.
+func reimport(t *testing.T, exported string) *stackRootfs {
+	store := &storeManager{path: t.TempDir(), logger: log.New(ioutil.Discard, "", 0)}
+	if err := store.importRootfs("exported", exported); err != nil {
+		t.Fatal(err)
+	}
+	return store.stackRootfs("exported")
+}
+
+func TestExportOCILayout(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	pulled := (&dockerClient{t: t, registry: registry.URL}).pull(appGUID)
+
+	layout := filepath.Join(t.TempDir(), "layout")
+	if err := registry.store.ExportOCILayout(appGUID, layout); err != nil {
+		t.Fatal(err)
+	}
+	if reimported := reimport(t, layout); !reflect.DeepEqual(reimported.layers, pulled.manifest.Layers) || !reflect.DeepEqual(reimported.diffIDs, pulled.config.Rootfs.DiffIDs) {
+		t.Errorf("exported %+v, pulled %+v", reimported, pulled.manifest)
+	}
+
+	tarball, err := someAppDroplet.Tarball()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.store.ConvertDroplet(bytes.NewReader(tarball), "some-image:v1", testDroplet("", string(tarball)), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.store.ExportOCILayout("some-image:v1", layout); err != nil {
+		t.Fatal(err)
+	}
+
+	var index ociIndex
+	if err := readJSONFile(filepath.Join(layout, "index.json"), &index); err != nil {
+		t.Fatal(err)
+	}
+	var refNames []string
+	for _, desc := range index.Manifests {
+		refNames = append(refNames, desc.Annotations[ociRefNameKey])
+		var m manifest
+		if err := readJSONFile(filepath.Join(layout, "blobs", "sha256", strings.TrimPrefix(desc.Digest, "sha256:")), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.MediaType != ociManifestMediaType || m.Config.MediaType != ociConfigMediaType || m.Layers[0].MediaType != ociLayerMediaType {
+			t.Errorf("manifest %s doesn't have OCI media types: %+v", desc.Digest, m)
+		}
+	}
+	if !reflect.DeepEqual(refNames, []string{"latest", "v1"}) {
+		t.Errorf("index has images %q", refNames)
+	}
+}
+
+func TestExportArchives(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	pulled := (&dockerClient{t: t, registry: registry.URL}).pull(appGUID)
+
+	archivePath := filepath.Join(t.TempDir(), "image.tar")
+	archive, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.store.ExportArchive(appGUID, dockerArchiveFormat, archive); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+	if reimported := reimport(t, archivePath); !reflect.DeepEqual(reimported.layers, pulled.manifest.Layers) {
+		t.Errorf("exported %+v, pulled %+v", reimported.layers, pulled.manifest.Layers)
+	}
+	var archiveManifest []dockerArchiveManifest
+	err = eachTarEntry(archivePath, func(header *tar.Header, r io.Reader) error {
+		if header.Name == "manifest.json" {
+			return json.NewDecoder(r).Decode(&archiveManifest)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archiveManifest) != 1 || !reflect.DeepEqual(archiveManifest[0].RepoTags, []string{appGUID + ":latest"}) {
+		t.Errorf("docker-archive manifest is %+v", archiveManifest)
+	}
+
+	var ociArchive bytes.Buffer
+	if err := registry.store.ExportArchive(appGUID+"@"+pulled.manifest.Config.Digest, ociArchiveFormat, &ociArchive); err == nil {
+		t.Errorf("expected exporting a digest that isn't a manifest to fail")
+	}
+	manifestDigest := "sha256:" + newestManifest(t, registry.store, appGUID)
+	if err := registry.store.ExportArchive(appGUID+"@"+manifestDigest, ociArchiveFormat, &ociArchive); err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]bool{}
+	tarReader := tar.NewReader(&ociArchive)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[header.Name] = true
+	}
+	for _, desc := range append(pulled.manifest.Layers, pulled.manifest.Config) {
+		if !entries["blobs/sha256/"+strings.TrimPrefix(desc.Digest, "sha256:")] {
+			t.Errorf("OCI archive is missing %s", desc.Digest)
+		}
+	}
+	if !entries["oci-layout"] || !entries["index.json"] {
+		t.Errorf("OCI archive has %v", entries)
+	}
+}
+
+func newestManifest(t *testing.T, store *storeManager, appGUID string) string {
+	manifests, err := store.appManifests(appGUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifests.newest()
+}
+
+func TestExportUnknownImages(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	for _, ref := range []string{"some-image", "some-image:v1", "Some-Image", "some-image@sha256:" + strings.Repeat("a", 64), "some-image@md5:abc"} {
+		if err := registry.store.ExportOCILayout(ref, t.TempDir()); err == nil {
+			t.Errorf("expected exporting %s to fail", ref)
+		}
+	}
+}
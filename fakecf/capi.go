@@ -0,0 +1,319 @@
+package fakecf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+func (s *Server) capiHandler() http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/v3/apps/{guid}", s.capi(s.getApp)).Methods("GET")
+	router.HandleFunc("/v3/apps/{guid}/droplets/current", s.capi(s.getCurrentDroplet)).Methods("GET")
+	router.HandleFunc("/v3/apps/{guid}/processes", s.capi(s.listProcesses)).Methods("GET")
+	router.HandleFunc("/v3/droplets/{guid}", s.capi(s.getDroplet)).Methods("GET")
+	router.HandleFunc("/v3/droplets/{guid}/download", s.capi(s.downloadDroplet)).Methods("GET")
+	router.HandleFunc("/v3/spaces/{guid}", s.capi(s.getSpace)).Methods("GET")
+	router.HandleFunc("/v3/roles", s.capi(s.listRoles)).Methods("GET")
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, 10000, "CF-NotFound", "Unknown request")
+	})
+	return router
+}
+
+// caller is who a CAPI request is made by: an admin, or a user.
+type caller struct {
+	admin bool
+	user  *user
+}
+
+type capiHandlerFunc func(w http.ResponseWriter, r *http.Request, c caller)
+
+// capi authenticates CAPI requests and holds the lock while handling them.
+func (s *Server) capi(handler capiHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		authorization := r.Header.Get("Authorization")
+		if strings.EqualFold(authorization, AdminToken) {
+			handler(w, r, caller{admin: true})
+			return
+		}
+		if u, ok := s.tokenUser(r); ok {
+			handler(w, r, caller{user: u})
+			return
+		}
+		writeError(w, http.StatusUnauthorized, 1000, "CF-InvalidAuthToken", "Invalid Auth Token")
+	}
+}
+
+// hasRole reports whether the caller has one of roleTypes in a space, or any
+// role there if none are given. Admins have every role.
+func (s *Server) hasRole(c caller, spaceGUID string, roleTypes ...string) bool {
+	if c.admin {
+		return true
+	}
+	for _, r := range s.roles {
+		if r.userGUID != c.user.guid || r.spaceGUID != spaceGUID {
+			continue
+		}
+		if len(roleTypes) == 0 || contains(roleTypes, r.roleType) {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleApp returns an app the caller may see, writing a 404 otherwise, as
+// CAPI does.
+func (s *Server) visibleApp(w http.ResponseWriter, c caller, appGUID string) (*app, bool) {
+	a, ok := s.apps[appGUID]
+	if !ok || !s.hasRole(c, a.spaceGUID) {
+		writeError(w, http.StatusNotFound, 10010, "CF-ResourceNotFound", "App not found")
+		return nil, false
+	}
+	return a, true
+}
+
+// visibleDroplet returns a droplet the caller may see through one of the
+// apps running it, along with that app.
+func (s *Server) visibleDroplet(w http.ResponseWriter, c caller, dropletGUID string) (*droplet, *app, bool) {
+	if d, ok := s.droplets[dropletGUID]; ok {
+		for _, a := range s.apps {
+			if a.currentDroplet == dropletGUID && s.hasRole(c, a.spaceGUID) {
+				return d, a, true
+			}
+		}
+	}
+	writeError(w, http.StatusNotFound, 10010, "CF-ResourceNotFound", "Droplet not found")
+	return nil, nil, false
+}
+
+func (s *Server) getApp(w http.ResponseWriter, r *http.Request, c caller) {
+	a, ok := s.visibleApp(w, c, mux.Vars(r)["guid"])
+	if !ok {
+		return
+	}
+	writeJSON(w, s.appResource(a))
+}
+
+func (s *Server) getCurrentDroplet(w http.ResponseWriter, r *http.Request, c caller) {
+	a, ok := s.visibleApp(w, c, mux.Vars(r)["guid"])
+	if !ok {
+		return
+	}
+	writeJSON(w, dropletResource(s.droplets[a.currentDroplet]))
+}
+
+func (s *Server) getDroplet(w http.ResponseWriter, r *http.Request, c caller) {
+	d, _, ok := s.visibleDroplet(w, c, mux.Vars(r)["guid"])
+	if !ok {
+		return
+	}
+	writeJSON(w, dropletResource(d))
+}
+
+// downloadDroplet redirects to the blobstore, which only space developers
+// may download from.
+func (s *Server) downloadDroplet(w http.ResponseWriter, r *http.Request, c caller) {
+	d, a, ok := s.visibleDroplet(w, c, mux.Vars(r)["guid"])
+	if !ok {
+		return
+	}
+	if !s.hasRole(c, a.spaceGUID, "space_developer") {
+		writeError(w, http.StatusForbidden, 10003, "CF-NotAuthorized", "You are not authorized to perform the requested action")
+		return
+	}
+	http.Redirect(w, r, s.Blobstore.URL+"/droplets/"+d.guid+"?signature="+d.checksum, http.StatusFound)
+}
+
+func (s *Server) listProcesses(w http.ResponseWriter, r *http.Request, c caller) {
+	a, ok := s.visibleApp(w, c, mux.Vars(r)["guid"])
+	if !ok {
+		return
+	}
+	var resources []interface{}
+	for _, p := range a.processes {
+		resources = append(resources, map[string]interface{}{
+			"guid":         a.guid + "-" + p.Type,
+			"type":         p.Type,
+			"command":      p.Command,
+			"instances":    1,
+			"memory_in_mb": 1024,
+			"disk_in_mb":   1024,
+		})
+	}
+	writeList(w, r, resources)
+}
+
+func (s *Server) getSpace(w http.ResponseWriter, r *http.Request, c caller) {
+	spaceGUID := mux.Vars(r)["guid"]
+	if !s.spaceExists(spaceGUID) || !s.hasRole(c, spaceGUID) {
+		writeError(w, http.StatusNotFound, 10010, "CF-ResourceNotFound", "Space not found")
+		return
+	}
+	writeJSON(w, map[string]interface{}{"guid": spaceGUID, "name": spaceGUID})
+}
+
+// spaceExists reports whether any app or role is in a space, since spaces
+// aren't created explicitly.
+func (s *Server) spaceExists(spaceGUID string) bool {
+	for _, a := range s.apps {
+		if a.spaceGUID == spaceGUID {
+			return true
+		}
+	}
+	for _, r := range s.roles {
+		if r.spaceGUID == spaceGUID {
+			return true
+		}
+	}
+	return false
+}
+
+// listRoles lists roles matching the user_guids, space_guids and types
+// filters. Users only see their own roles.
+func (s *Server) listRoles(w http.ResponseWriter, r *http.Request, c caller) {
+	filters := map[string][]string{}
+	for _, filter := range []string{"user_guids", "space_guids", "types"} {
+		if value := r.URL.Query().Get(filter); value != "" {
+			filters[filter] = strings.Split(value, ",")
+		}
+	}
+
+	var resources []interface{}
+	for _, role := range s.roles {
+		if !c.admin && role.userGUID != c.user.guid {
+			continue
+		}
+		if !matches(filters["user_guids"], role.userGUID) || !matches(filters["space_guids"], role.spaceGUID) || !matches(filters["types"], role.roleType) {
+			continue
+		}
+		resources = append(resources, map[string]interface{}{
+			"guid": role.guid,
+			"type": role.roleType,
+			"relationships": map[string]interface{}{
+				"user":  relationship(role.userGUID),
+				"space": relationship(role.spaceGUID),
+			},
+		})
+	}
+	writeList(w, r, resources)
+}
+
+func (s *Server) appResource(a *app) map[string]interface{} {
+	return map[string]interface{}{
+		"guid":  a.guid,
+		"name":  a.name,
+		"state": "STARTED",
+		"lifecycle": map[string]interface{}{
+			"type": "buildpack",
+			"data": map[string]interface{}{"stack": s.droplets[a.currentDroplet].stack, "buildpacks": []string{}},
+		},
+		"relationships": map[string]interface{}{"space": relationship(a.spaceGUID)},
+	}
+}
+
+func dropletResource(d *droplet) map[string]interface{} {
+	return map[string]interface{}{
+		"guid":          d.guid,
+		"state":         "STAGED",
+		"stack":         d.stack,
+		"checksum":      map[string]string{"type": "sha256", "value": d.checksum},
+		"process_types": d.processTypes,
+	}
+}
+
+func relationship(guid string) map[string]interface{} {
+	return map[string]interface{}{"data": map[string]string{"guid": guid}}
+}
+
+// serveDroplet is the blobstore. Like S3, it refuses requests that carry
+// credentials besides the signed URL.
+func (s *Server) serveDroplet(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r.Header.Get("Authorization") != "" {
+		http.Error(w, "only one auth mechanism allowed", http.StatusBadRequest)
+		return
+	}
+	d, ok := s.droplets[strings.TrimPrefix(r.URL.Path, "/droplets/")]
+	if !ok || r.URL.Query().Get("signature") != d.checksum {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	s.downloads++
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Write(d.tarball)
+}
+
+// writeList writes a page of resources, honouring the page and per_page
+// parameters.
+func writeList(w http.ResponseWriter, r *http.Request, resources []interface{}) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = 50
+	}
+
+	start, end := (page-1)*perPage, page*perPage
+	if start > len(resources) {
+		start = len(resources)
+	}
+	if end > len(resources) {
+		end = len(resources)
+	}
+
+	pagination := map[string]interface{}{
+		"total_results": len(resources),
+		"total_pages":   (len(resources) + perPage - 1) / perPage,
+		"next":          nil,
+	}
+	if end < len(resources) {
+		query := url.Values{}
+		for key, values := range r.URL.Query() {
+			query[key] = values
+		}
+		query.Set("page", strconv.Itoa(page+1))
+		query.Set("per_page", strconv.Itoa(perPage))
+		pagination["next"] = map[string]string{"href": fmt.Sprintf("http://%s%s?%s", r.Host, r.URL.Path, query.Encode())}
+	}
+	writeJSON(w, map[string]interface{}{"pagination": pagination, "resources": append([]interface{}{}, resources[start:end]...)})
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError writes an error in the CAPI v3 format.
+func writeError(w http.ResponseWriter, status, code int, title, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]interface{}{{"code": code, "title": title, "detail": detail}},
+	})
+}
+
+func matches(filter []string, value string) bool {
+	return len(filter) == 0 || contains(filter, value)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
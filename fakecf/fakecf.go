@@ -0,0 +1,252 @@
+// Package fakecf is an in-process fake of the parts of Cloud Foundry the
+// registry talks to: the CAPI v3 endpoints for apps, droplets, processes,
+// spaces and roles, a blobstore droplets are downloaded from, and the UAA
+// endpoints for logging in.
+package fakecf
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// AdminToken is the Authorization header value for a CAPI token that may see
+// everything, like the one the registry is usually run with.
+const AdminToken = "bearer admin-token"
+
+// ClientID and ClientSecret are the UAA client users log in with.
+const (
+	ClientID     = "cf"
+	ClientSecret = ""
+)
+
+// Server fakes CAPI, UAA and the blobstore, each on its own host, so that
+// credentials leaking across redirects would be noticed.
+type Server struct {
+	CAPI      *httptest.Server
+	UAA       *httptest.Server
+	Blobstore *httptest.Server
+
+	lock      sync.Mutex
+	users     map[string]*user // by guid
+	tokens    map[string]*user // by access token
+	apps      map[string]*app
+	droplets  map[string]*droplet
+	roles     []role
+	downloads int
+}
+
+type user struct {
+	guid, name, password string
+}
+
+type app struct {
+	guid, name, spaceGUID string
+	currentDroplet        string
+	processes             []Process
+}
+
+type droplet struct {
+	guid, stack  string
+	tarball      []byte
+	checksum     string
+	processTypes map[string]string
+}
+
+type role struct {
+	guid, roleType, userGUID, spaceGUID string
+}
+
+// Process is a process of a fake app.
+type Process struct {
+	Type    string
+	Command string
+}
+
+// File is an entry of a fake droplet. Entries with a Linkname are symlinks,
+// and entries whose name ends with a slash are directories.
+type File struct {
+	Name     string
+	Contents string
+	Linkname string
+	Mode     int64
+}
+
+// Droplet describes a fake app's droplet, which is generated as a gzipped
+// tarball with relative entry names, the way the CF stagers produce them.
+type Droplet struct {
+	Stack        string
+	Files        []File
+	ProcessTypes map[string]string
+}
+
+// New starts a fake CF. Close it when done.
+func New() *Server {
+	s := &Server{
+		users:    map[string]*user{},
+		tokens:   map[string]*user{},
+		apps:     map[string]*app{},
+		droplets: map[string]*droplet{},
+	}
+	s.CAPI = httptest.NewServer(s.capiHandler())
+	s.UAA = httptest.NewServer(s.uaaHandler())
+	s.Blobstore = httptest.NewServer(http.HandlerFunc(s.serveDroplet))
+	return s
+}
+
+func (s *Server) Close() {
+	s.CAPI.Close()
+	s.UAA.Close()
+	s.Blobstore.Close()
+}
+
+// AddUser adds a user who can log in with a password, returning their guid.
+func (s *Server) AddUser(name, password string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u := &user{guid: uuid.New(), name: name, password: password}
+	s.users[u.guid] = u
+	return u.guid
+}
+
+// AddRole gives a user a role, such as space_developer, in a space.
+func (s *Server) AddRole(userGUID, spaceGUID, roleType string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.roles = append(s.roles, role{guid: uuid.New(), roleType: roleType, userGUID: userGUID, spaceGUID: spaceGUID})
+}
+
+// PushApp adds an app in a space, running a droplet, returning the app's
+// guid.
+func (s *Server) PushApp(name, spaceGUID string, d Droplet) (string, error) {
+	appGUID := uuid.New()
+	s.lock.Lock()
+	s.apps[appGUID] = &app{guid: appGUID, name: name, spaceGUID: spaceGUID}
+	s.lock.Unlock()
+
+	return appGUID, s.Stage(appGUID, d)
+}
+
+// Stage gives an app a new current droplet, with a process for each of its
+// process types.
+func (s *Server) Stage(appGUID string, d Droplet) error {
+	tarball, err := dropletTarball(d.Files)
+	if err != nil {
+		return err
+	}
+	checksum := sha256.Sum256(tarball)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, ok := s.apps[appGUID]
+	if !ok {
+		return fmt.Errorf("app %s doesn't exist", appGUID)
+	}
+	staged := &droplet{
+		guid:         uuid.New(),
+		stack:        d.Stack,
+		tarball:      tarball,
+		checksum:     hex.EncodeToString(checksum[:]),
+		processTypes: d.ProcessTypes,
+	}
+	s.droplets[staged.guid] = staged
+	a.currentDroplet = staged.guid
+
+	var types []string
+	for processType := range d.ProcessTypes {
+		types = append(types, processType)
+	}
+	sort.Strings(types)
+	a.processes = nil
+	for _, processType := range types {
+		a.processes = append(a.processes, Process{Type: processType, Command: d.ProcessTypes[processType]})
+	}
+	return nil
+}
+
+// DropletDownloads returns how many times droplets have been downloaded from
+// the blobstore.
+func (s *Server) DropletDownloads() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.downloads
+}
+
+// Tarball generates the droplet's tarball, as the blobstore would serve it.
+// Entries are timestamped when it is generated.
+func (d Droplet) Tarball() ([]byte, error) {
+	return dropletTarball(d.Files)
+}
+
+func dropletTarball(files []File) ([]byte, error) {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Now()}); err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		header := &tar.Header{Name: "./" + file.Name, Mode: file.Mode, ModTime: time.Now()}
+		switch {
+		case file.Linkname != "":
+			header.Typeflag, header.Linkname = tar.TypeSymlink, file.Linkname
+		case strings.HasSuffix(file.Name, "/"):
+			header.Typeflag = tar.TypeDir
+		default:
+			header.Typeflag, header.Size = tar.TypeReg, int64(len(file.Contents))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+			if header.Typeflag == tar.TypeDir {
+				header.Mode = 0755
+			}
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tarWriter.Write([]byte(file.Contents)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// accessToken returns a JWT-shaped token for a user, which UAA and CAPI
+// recognise until it expires. It isn't signed.
+func (s *Server) accessToken(u *user) string {
+	claims, _ := json.Marshal(map[string]interface{}{
+		"jti":       uuid.New(),
+		"user_id":   u.guid,
+		"user_name": u.name,
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	})
+	token := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claims) + ".fake"
+	s.tokens[token] = u
+	return token
+}
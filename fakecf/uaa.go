@@ -0,0 +1,71 @@
+package fakecf
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+func (s *Server) uaaHandler() http.Handler {
+	router := http.NewServeMux()
+	router.HandleFunc("/oauth/token", s.passwordGrant)
+	router.HandleFunc("/userinfo", s.userInfo)
+	return router
+}
+
+// AccessToken logs a user in without their password.
+func (s *Server) AccessToken(userGUID string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accessToken(s.users[userGUID])
+}
+
+func (s *Server) passwordGrant(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	clientID, clientSecret, _ := r.BasicAuth()
+	if r.Method != "POST" || clientID != ClientID || clientSecret != ClientSecret || r.FormValue("grant_type") != "password" {
+		writeUAAError(w, http.StatusUnauthorized, "unauthorized", "Bad client credentials")
+		return
+	}
+	for _, u := range s.users {
+		if u.name == r.FormValue("username") && u.password == r.FormValue("password") {
+			writeJSON(w, map[string]interface{}{
+				"access_token": s.accessToken(u),
+				"token_type":   "bearer",
+				"expires_in":   3599,
+			})
+			return
+		}
+	}
+	writeUAAError(w, http.StatusUnauthorized, "unauthorized", "Bad credentials")
+}
+
+func (s *Server) userInfo(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if u, ok := s.tokenUser(r); ok {
+		writeJSON(w, map[string]string{"user_id": u.guid, "sub": u.guid, "user_name": u.name})
+		return
+	}
+	writeUAAError(w, http.StatusUnauthorized, "invalid_token", "Invalid access token")
+}
+
+// tokenUser returns the user whose access token a request is made with. It
+// is called with the lock held.
+func (s *Server) tokenUser(r *http.Request) (*user, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) <= len("bearer ") || !strings.EqualFold(authorization[:len("bearer ")], "bearer ") {
+		return nil, false
+	}
+	u, ok := s.tokens[authorization[len("bearer "):]]
+	return u, ok
+}
+
+func writeUAAError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
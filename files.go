@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pborman/uuid"
+)
+
+func readJSONFile(filePath string, result interface{}) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewDecoder(file).Decode(result)
+}
+
+// writeJSONFile atomically replaces a file with the JSON encoding of value.
+func writeJSONFile(filePath string, value interface{}) error {
+	contents, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	tempPath := filepath.Join(filepath.Dir(filePath), uuid.New())
+	if err := ioutil.WriteFile(tempPath, contents, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+func fileExists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return err == nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
+)
+
+// fsck checks that every blob and downloaded droplet matches the checksum it
+// is named after, that every record can be read and that everything they
+// refer to is in the store, returning a description of each problem found.
+func (s *storeManager) fsck() ([]string, error) {
+	refs, problems, err := s.blobReferences(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := s.storeFiles()
+	if err != nil {
+		return nil, err
+	}
+	present := map[string]bool{}
+	for _, file := range files {
+		name := file.Name()
+
+		switch storeFileKindOf(name) {
+		case blobFile:
+			// Blobs are only read from blobPath, so in an OCI store one at
+			// the top level is as good as missing.
+			if file.path != s.blobPath(name) {
+				problems = append(problems, fmt.Sprintf("unexpected file %s", name))
+				continue
+			}
+			present[name] = true
+			checksum, err := s.checksumFile(file.path, sha256.New())
+			if err != nil {
+				return nil, err
+			}
+			if checksum != name && checksum != "" {
+				problems = append(problems, fmt.Sprintf("blob %s is corrupt: its contents have checksum %s", name, checksum))
+			}
+
+		case dropletFile:
+			var droplet capi.Droplet
+			parts := strings.SplitN(strings.TrimPrefix(name, "droplet-"), "-", 2)
+			if len(parts) == 2 {
+				droplet.Checksum.Type, droplet.Checksum.Value = parts[0], parts[1]
+			}
+			if key, err := dropletKey(droplet); err != nil || key != name {
+				problems = append(problems, fmt.Sprintf("unexpected file %s", name))
+				continue
+			}
+			checksum, err := s.checksumFile(file.path, dropletChecksumHash(droplet))
+			if err != nil {
+				return nil, err
+			}
+			if checksum != droplet.Checksum.Value && checksum != "" {
+				problems = append(problems, fmt.Sprintf("droplet %s is corrupt: its contents have %s checksum %s", name, droplet.Checksum.Type, checksum))
+			}
+
+		case layoutFile:
+			if !s.ociLayout {
+				problems = append(problems, fmt.Sprintf("unexpected file %s", name))
+				continue
+			}
+			if name == "index.json" {
+				var index ociIndex
+				if err := readJSONFile(file.path, &index); err != nil {
+					problems = append(problems, fmt.Sprintf("index.json can't be read: %s", err))
+				}
+			}
+
+		case unknownFile:
+			problems = append(problems, fmt.Sprintf("unexpected file %s", name))
+		}
+	}
+
+	for checksum, referrers := range refs {
+		if !present[checksum] {
+			problems = append(problems, fmt.Sprintf("blob %s is missing, but is referred to by %s", checksum, strings.Join(referrers, ", ")))
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// checksumFile returns the checksum of a file in the store, or an empty string
+// if it has been removed since the store was listed.
+func (s *storeManager) checksumFile(filePath string, summer hash.Hash) (string, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(summer, file); err != nil {
+		return "", fmt.Errorf("reading %s: %s", filepath.Base(filePath), err)
+	}
+	return hex.EncodeToString(summer.Sum(nil)), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	image := (&dockerClient{t: t, registry: registry.URL}).pull(appGUID)
+
+	problems, err := registry.store.fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+
+	layer := strings.TrimPrefix(image.manifest.Layers[1].Digest, "sha256:")
+	file, err := os.OpenFile(registry.store.blobPath(layer), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("garbage"))
+	file.Close()
+	config := strings.TrimPrefix(image.manifest.Config.Digest, "sha256:")
+	if err := os.Remove(registry.store.blobPath(config)); err != nil {
+		t.Fatal(err)
+	}
+	writeStoreFile(t, registry.store, "notes.txt", "", 0)
+
+	problems, err = registry.store.fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"blob " + layer + " is corrupt",
+		"blob " + config + " is missing, but is referred to by manifest",
+		"unexpected file notes.txt",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for _, problem := range expected {
+		found := false
+		for _, actual := range problems {
+			found = found || strings.HasPrefix(actual, problem)
+		}
+		if !found {
+			t.Errorf("expected a problem starting %q in %v", problem, problems)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// storeFileKind is what a file in the store is, going by its name.
+type storeFileKind int
+
+const (
+	blobFile storeFileKind = iota
+	dropletFile
+	convertedDropletFile
+	appManifestsFile
+	stackRecordFile
+	imageFile
+	pushRecordFile
+	layoutFile
+	tempFile
+	unknownFile
+)
+
+func storeFileKindOf(name string) storeFileKind {
+	switch {
+	case isDigestHex(name):
+		return blobFile
+	case strings.HasPrefix(name, "droplet-") && strings.HasSuffix(name, "-layers"):
+		return convertedDropletFile
+	case strings.HasPrefix(name, "droplet-"):
+		return dropletFile
+	case strings.HasPrefix(name, "app-") && strings.HasSuffix(name, "-manifests"):
+		return appManifestsFile
+	case strings.HasPrefix(name, "stack-"):
+		return stackRecordFile
+	case strings.HasPrefix(name, "image-"):
+		return imageFile
+	case strings.HasPrefix(name, "pushed-"):
+		return pushRecordFile
+	case name == "oci-layout" || name == "index.json" || name == "blobs":
+		return layoutFile
+	case uuid.Parse(name) != nil:
+		return tempFile
+	default:
+		return unknownFile
+	}
+}
+
+func isDigestHex(name string) bool {
+	_, err := digestHex("sha256:" + name)
+	return err == nil
+}
+
+// blobReferences maps the blobs the store's records refer to, directly or
+// through a recorded manifest, to what refers to them.
+type blobReferences map[string][]string
+
+func (r blobReferences) add(descs []descriptor, referrer string) {
+	for _, desc := range descs {
+		if checksum, err := digestHex(desc.Digest); err == nil {
+			r[checksum] = append(r[checksum], referrer)
+		}
+	}
+}
+
+// blobReferences finds the blobs referred to by the store's stack, converted
+// droplet, app manifest and image records, skipping app manifests for which
+// skip returns true. Records and manifests that can't be read are returned as
+// problems, since what they refer to is unknown.
+func (s *storeManager) blobReferences(skip func(appGUID, manifestChecksum string) bool) (blobReferences, []string, error) {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refs := blobReferences{}
+	var problems []string
+	for _, file := range files {
+		name := file.Name()
+		switch storeFileKindOf(name) {
+		case stackRecordFile:
+			var record stackRecord
+			if err := readJSONFile(filepath.Join(s.path, name), &record); err != nil {
+				problems = append(problems, fmt.Sprintf("stack record %s can't be read: %s", name, err))
+				continue
+			}
+			refs.add(record.Layers, "stack "+strings.TrimPrefix(name, "stack-"))
+
+		case convertedDropletFile:
+			var converted convertedDroplet
+			if err := readJSONFile(filepath.Join(s.path, name), &converted); err != nil {
+				problems = append(problems, fmt.Sprintf("converted droplet record %s can't be read: %s", name, err))
+				continue
+			}
+			refs.add(converted.Layers, "converted droplet "+strings.TrimSuffix(name, "-layers"))
+
+		case appManifestsFile:
+			appGUID := strings.TrimSuffix(strings.TrimPrefix(name, "app-"), "-manifests")
+			manifests, err := s.appManifests(appGUID)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			for manifestChecksum := range manifests.Manifests {
+				if skip != nil && skip(appGUID, manifestChecksum) {
+					continue
+				}
+				problems = append(problems, s.addManifestReferences(refs, manifestChecksum, "app "+appGUID)...)
+			}
+
+		case imageFile:
+			imageName := strings.TrimPrefix(name, "image-")
+			image, err := s.image(imageName)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			for tag, record := range image.Tags {
+				manifestChecksum, err := digestHex(record.Manifest)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("image %s:%s: %s", imageName, tag, err))
+					continue
+				}
+				problems = append(problems, s.addManifestReferences(refs, manifestChecksum, "image "+imageName+":"+tag)...)
+			}
+		}
+	}
+	return refs, problems, nil
+}
+
+// addManifestReferences adds a manifest blob and the blobs it refers to.
+func (s *storeManager) addManifestReferences(refs blobReferences, manifestChecksum, owner string) []string {
+	refs[manifestChecksum] = append(refs[manifestChecksum], owner)
+
+	referrer := fmt.Sprintf("manifest sha256:%s of %s", manifestChecksum, owner)
+	var m manifest
+	if err := readJSONFile(s.blobPath(manifestChecksum), &m); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s can't be read: %s", referrer, err)}
+	}
+	refs.add(append([]descriptor{m.Config}, m.Layers...), referrer)
+	return nil
+}
+
+// gcReport describes what gc removed, or would remove in a dry run.
+type gcReport struct {
+	expiredManifests []string
+	removed          []string
+	removedBytes     int64
+}
+
+// gc removes blobs that no record refers to and abandoned temporary files,
+// leaving those modified within gracePeriod in case they belong to an import
+// or conversion in progress. If maxManifestAge is positive, manifests recorded
+// for an app longer ago than that are forgotten first, apart from its newest
+// one, so that they can no longer be pulled by digest. Downloaded droplets are
+// left to store.max_droplet_cache_bytes.
+func (s *storeManager) gc(gracePeriod, maxManifestAge time.Duration, dryRun bool) (gcReport, error) {
+	var report gcReport
+	now := time.Now()
+
+	expired := map[string]map[string]bool{}
+	if maxManifestAge > 0 {
+		var err error
+		expired, err = s.expiredManifests(now.Add(-maxManifestAge))
+		if err != nil {
+			return report, err
+		}
+	}
+	isExpired := func(appGUID, manifestChecksum string) bool {
+		return expired[appGUID][manifestChecksum]
+	}
+
+	refs, problems, err := s.blobReferences(isExpired)
+	if err != nil {
+		return report, err
+	}
+	if len(problems) > 0 {
+		return report, fmt.Errorf("not collecting garbage, since what some records refer to is unknown:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	var appGUIDs []string
+	for appGUID := range expired {
+		appGUIDs = append(appGUIDs, appGUID)
+	}
+	sort.Strings(appGUIDs)
+	for _, appGUID := range appGUIDs {
+		if !dryRun {
+			if err := s.forgetManifests(appGUID, expired[appGUID]); err != nil {
+				return report, err
+			}
+		}
+		for manifestChecksum := range expired[appGUID] {
+			report.expiredManifests = append(report.expiredManifests, fmt.Sprintf("sha256:%s of app %s", manifestChecksum, appGUID))
+		}
+	}
+	sort.Strings(report.expiredManifests)
+
+	files, err := s.storeFiles()
+	if err != nil {
+		return report, err
+	}
+	for _, file := range files {
+		kind := storeFileKindOf(file.Name())
+		if kind != tempFile && (kind != blobFile || refs[file.Name()] != nil) {
+			continue
+		}
+		if now.Sub(file.ModTime()) < gracePeriod {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				return report, err
+			}
+		}
+		report.removed = append(report.removed, file.Name())
+		report.removedBytes += file.Size()
+	}
+	return report, nil
+}
+
+// expiredManifests returns, by app, the manifests recorded before cutoff that
+// aren't the app's newest.
+func (s *storeManager) expiredManifests(cutoff time.Time) (map[string]map[string]bool, error) {
+	recordPaths, err := filepath.Glob(s.appManifestsPath("*"))
+	if err != nil {
+		return nil, err
+	}
+
+	expired := map[string]map[string]bool{}
+	for _, recordPath := range recordPaths {
+		appGUID := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(recordPath), "app-"), "-manifests")
+		manifests, err := s.appManifests(appGUID)
+		if err != nil {
+			return nil, err
+		}
+
+		newest := manifests.newest()
+		for manifestChecksum, record := range manifests.Manifests {
+			if manifestChecksum != newest && record.Created.Before(cutoff) {
+				if expired[appGUID] == nil {
+					expired[appGUID] = map[string]bool{}
+				}
+				expired[appGUID][manifestChecksum] = true
+			}
+		}
+	}
+	return expired, nil
+}
+
+// forgetManifests removes manifests from an app's record.
+func (s *storeManager) forgetManifests(appGUID string, manifestChecksums map[string]bool) error {
+	s.manifestsLock.Lock()
+	defer s.manifestsLock.Unlock()
+
+	manifests, err := s.appManifests(appGUID)
+	if err != nil {
+		return err
+	}
+	for manifestChecksum := range manifestChecksums {
+		delete(manifests.Manifests, manifestChecksum)
+	}
+	if err := writeJSONFile(s.appManifestsPath(appGUID), manifests); err != nil {
+		return fmt.Errorf("recording manifests of app %s: %s", appGUID, err)
+	}
+	return s.writeIndex()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masters-of-cats/droplet-registry-spike/fakecf"
+	"github.com/pborman/uuid"
+)
+
+// pullTwice pulls an app, restages it and pulls it again, returning the
+// manifests of both pulls.
+func pullTwice(t *testing.T, registry *testRegistry) (string, pulledImage, pulledImage) {
+	appGUID := registry.pushApp(t, someAppDroplet)
+	client := &dockerClient{t: t, registry: registry.URL}
+	before := client.pull(appGUID)
+	restaged := fakecf.Droplet{Stack: defaultStack, Files: []fakecf.File{{Name: "app/server.rb", Contents: "puts 'hello again'"}}}
+	if err := registry.cf.Stage(appGUID, restaged); err != nil {
+		t.Fatal(err)
+	}
+	return appGUID, before, client.pull(appGUID)
+}
+
+func writeStoreFile(t *testing.T, store *storeManager, name, contents string, age time.Duration) {
+	filePath := filepath.Join(store.path, name)
+	if err := ioutil.WriteFile(filePath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-age)
+	if err := os.Chtimes(filePath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storeHas(store *storeManager, digest string) bool {
+	return fileExists(store.blobPath(strings.TrimPrefix(digest, "sha256:")))
+}
+
+func TestGCRemovesUnreferencedBlobsAndTempFiles(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	_, before, after := pullTwice(t, registry)
+
+	oldBlob, newBlob, oldTemp := strings.Repeat("a", 64), strings.Repeat("b", 64), uuid.New()
+	writeStoreFile(t, registry.store, oldBlob, "old", 2*time.Hour)
+	writeStoreFile(t, registry.store, newBlob, "new", 0)
+	writeStoreFile(t, registry.store, oldTemp, "temp", 2*time.Hour)
+
+	report, err := registry.store.gc(time.Hour, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.removed) != 2 || report.removedBytes != 7 {
+		t.Errorf("dry run would remove %v (%d bytes)", report.removed, report.removedBytes)
+	}
+	if !storeHas(registry.store, oldBlob) {
+		t.Fatal("dry run removed a blob")
+	}
+
+	if _, err := registry.store.gc(time.Hour, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if storeHas(registry.store, oldBlob) || fileExists(filepath.Join(registry.store.path, oldTemp)) {
+		t.Errorf("old unreferenced files were left")
+	}
+	if !storeHas(registry.store, newBlob) {
+		t.Errorf("a blob within the grace period was removed")
+	}
+	for _, image := range []pulledImage{before, after} {
+		for _, desc := range append(image.manifest.Layers, image.manifest.Config) {
+			if !storeHas(registry.store, desc.Digest) {
+				t.Errorf("referenced blob %s was removed", desc.Digest)
+			}
+		}
+	}
+}
+
+func TestGCForgetsOldManifests(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID, before, after := pullTwice(t, registry)
+
+	manifests, err := registry.store.appManifests(appGUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for manifestChecksum, record := range manifests.Manifests {
+		record.Created = record.Created.Add(-48 * time.Hour)
+		manifests.Manifests[manifestChecksum] = record
+	}
+	if err := writeJSONFile(registry.store.appManifestsPath(appGUID), manifests); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := registry.store.gc(0, 24*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.expiredManifests) != 1 {
+		t.Fatalf("expected one manifest to be forgotten, got %v", report.expiredManifests)
+	}
+	if manifests, _ := registry.store.appManifests(appGUID); len(manifests.Manifests) != 1 {
+		t.Errorf("app has %d manifests recorded", len(manifests.Manifests))
+	}
+	if storeHas(registry.store, before.manifest.Config.Digest) {
+		t.Errorf("config of the forgotten manifest was left")
+	}
+	if !storeHas(registry.store, after.manifest.Config.Digest) {
+		t.Errorf("config of the newest manifest was removed")
+	}
+
+	client := &dockerClient{t: t, registry: registry.URL}
+	client.pull(appGUID)
+}
+
+func TestGCRefusesWithUnreadableRecords(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	writeStoreFile(t, registry.store, "stack-broken", "{", 2*time.Hour)
+	writeStoreFile(t, registry.store, strings.Repeat("a", 64), "old", 2*time.Hour)
+
+	if _, err := registry.store.gc(time.Hour, 0, false); err == nil || !strings.Contains(err.Error(), "stack-broken") {
+		t.Errorf("expected gc to refuse, got %v", err)
+	}
+	if !storeHas(registry.store, strings.Repeat("a", 64)) {
+		t.Errorf("gc removed a blob")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
+	"github.com/pborman/uuid"
+)
+
+// localImage records the tags of an image converted from a droplet tarball
+// rather than from an app's droplet in CAPI, as image-<name>. The manifests
+// themselves are blobs.
+type localImage struct {
+	Tags map[string]imageTag `json:"tags"`
+}
+
+type imageTag struct {
+	Manifest string    `json:"manifest"`
+	Stack    string    `json:"stack"`
+	Droplet  string    `json:"droplet"`
+	Created  time.Time `json:"created"`
+}
+
+var (
+	imageNamePattern = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+	imageTagPattern  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// parseImageReference splits an image reference into its name and tag, which
+// is latest if it has none.
+func parseImageReference(ref string) (string, string, error) {
+	name, tag := ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i >= 0 {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	if !imageNamePattern.MatchString(name) {
+		return "", "", fmt.Errorf("invalid image name %q: expected lowercase letters, digits and separators", name)
+	}
+	if !imageTagPattern.MatchString(tag) {
+		return "", "", fmt.Errorf("invalid image tag %q", tag)
+	}
+	return name, tag, nil
+}
+
+// ConvertDroplet converts a droplet tarball that didn't come from CAPI, such
+// as one saved by `cf download-droplet` or produced by a local stager, into an
+// image tagged ref, returning the digest of its manifest. metadata is in the
+// shape CAPI reports droplets in and gives the droplet's stack, which is
+// cflinuxfs2 if it has none, and optionally its checksum and process types.
+// The command of processType, or of the web process if it is empty, becomes
+// the image's Cmd. The droplet is converted exactly as an app's droplet is,
+// and only once.
+func (s *storeManager) ConvertDroplet(droplet io.Reader, ref string, metadata capi.Droplet, processType string) (string, error) {
+	name, tag, err := parseImageReference(ref)
+	if err != nil {
+		return "", err
+	}
+	if metadata.Stack == "" {
+		metadata.Stack = defaultStack
+	}
+	rootfs := s.stackRootfs(metadata.Stack)
+	if rootfs == nil {
+		return "", fmt.Errorf("this registry has no rootfs for stack %s", metadata.Stack)
+	}
+	command, err := processCommand(metadata, processType)
+	if err != nil {
+		return "", err
+	}
+
+	s.logger.Printf("converting droplet into %s:%s...", name, tag)
+	defer s.logger.Printf("done converting droplet into %s:%s", name, tag)
+
+	key, err := s.importDroplet(droplet, metadata)
+	if err != nil {
+		return "", err
+	}
+	manifestJson, err := s.dropletManifest(key, key, rootfs, command, func() (string, error) {
+		return filepath.Join(s.path, key), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	checksum, err := s.storeManifest(manifestJson)
+	if err != nil {
+		return "", err
+	}
+
+	record := imageTag{Manifest: "sha256:" + checksum, Stack: metadata.Stack, Droplet: key, Created: time.Now().UTC()}
+	if err := s.tagImage(name, tag, record); err != nil {
+		return "", err
+	}
+	return record.Manifest, nil
+}
+
+// processCommand returns the command of a droplet's process type, which is
+// the web process's, if it has one, if processType is empty.
+func processCommand(metadata capi.Droplet, processType string) (string, error) {
+	if processType == "" {
+		return metadata.ProcessTypes["web"], nil
+	}
+	command, ok := metadata.ProcessTypes[processType]
+	if !ok {
+		var types []string
+		for processType := range metadata.ProcessTypes {
+			types = append(types, processType)
+		}
+		if len(types) == 0 {
+			return "", fmt.Errorf("droplet has no %s process, since its metadata has no process types", processType)
+		}
+		sort.Strings(types)
+		return "", fmt.Errorf("droplet has no %s process, only %s", processType, strings.Join(types, ", "))
+	}
+	return command, nil
+}
+
+// importDroplet copies a droplet tarball into the store, where it is cached
+// alongside droplets downloaded from CAPI, returning its key. It is checked
+// against the checksum in metadata, if there is one.
+func (s *storeManager) importDroplet(r io.Reader, metadata capi.Droplet) (string, error) {
+	if err := os.MkdirAll(s.path, 0700); err != nil {
+		return "", fmt.Errorf("creating store: %s", err)
+	}
+
+	checksumType := metadata.Checksum.Type
+	if checksumType == "" {
+		checksumType = "sha256"
+	}
+	if checksumType != "sha256" && checksumType != "sha1" {
+		return "", fmt.Errorf("droplet has unsupported checksum type %q", checksumType)
+	}
+	var keyed capi.Droplet
+	keyed.Checksum.Type = checksumType
+	summer := dropletChecksumHash(keyed)
+
+	file, err := os.Create(filepath.Join(s.path, uuid.New()))
+	if err != nil {
+		return "", fmt.Errorf("creating droplet file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := io.Copy(io.MultiWriter(file, summer), r); err != nil {
+		return "", fmt.Errorf("writing droplet to a file: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("closing droplet file: %s", err)
+	}
+
+	checksum := hex.EncodeToString(summer.Sum(nil))
+	if metadata.Checksum.Value != "" && checksum != strings.ToLower(metadata.Checksum.Value) {
+		return "", fmt.Errorf("droplet has %s checksum %s, but its metadata says %s", checksumType, checksum, metadata.Checksum.Value)
+	}
+	key := "droplet-" + checksumType + "-" + checksum
+	return key, os.Rename(file.Name(), filepath.Join(s.path, key))
+}
+
+func (s *storeManager) imagePath(name string) string {
+	return filepath.Join(s.path, "image-"+name)
+}
+
+// image returns the tags of a local image, which are none if it has never
+// been converted.
+func (s *storeManager) image(name string) (localImage, error) {
+	var image localImage
+	err := readJSONFile(s.imagePath(name), &image)
+	if err != nil && !os.IsNotExist(err) {
+		return localImage{}, fmt.Errorf("reading tags of image %s: %s", name, err)
+	}
+	return image, nil
+}
+
+// tagImage points a tag of a local image at a manifest, replacing whatever
+// it pointed at before.
+func (s *storeManager) tagImage(name, tag string, record imageTag) error {
+	s.manifestsLock.Lock()
+	defer s.manifestsLock.Unlock()
+
+	image, err := s.image(name)
+	if err != nil {
+		return err
+	}
+	if image.Tags == nil {
+		image.Tags = map[string]imageTag{}
+	}
+	image.Tags[tag] = record
+	if err := writeJSONFile(s.imagePath(name), image); err != nil {
+		return fmt.Errorf("recording tags of image %s: %s", name, err)
+	}
+	return s.writeIndex()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pborman/uuid"
+)
+
+// layerWriter writes a gzipped layer tarball to a temporary file in the
+// store, calculating the compressed and uncompressed checksums as it goes.
+type layerWriter struct {
+	*tar.Writer
+	file               *os.File
+	zipWriter          *gzip.Writer
+	summer             hash.Hash
+	uncompressedSummer hash.Hash
+	counter            *byteCounter
+}
+
+func newLayerWriter(storePath string) (*layerWriter, error) {
+	file, err := os.Create(filepath.Join(storePath, uuid.New()))
+	if err != nil {
+		return nil, fmt.Errorf("opening temporary layer file: %s", err)
+	}
+
+	l := &layerWriter{
+		file:               file,
+		summer:             sha256.New(),
+		uncompressedSummer: sha256.New(),
+		counter:            new(byteCounter),
+	}
+	l.zipWriter = gzip.NewWriter(io.MultiWriter(l.summer, file, l.counter))
+	l.Writer = tar.NewWriter(io.MultiWriter(l.zipWriter, l.uncompressedSummer))
+	return l, nil
+}
+
+// commit finishes the layer and moves it to blobPath of its checksum,
+// returning its descriptor and diff ID.
+func (l *layerWriter) commit(blobPath func(checksum string) string) (descriptor, string, error) {
+	if err := l.Writer.Close(); err != nil {
+		return descriptor{}, "", fmt.Errorf("closing layer tarstream: %s", err)
+	}
+	if err := l.zipWriter.Close(); err != nil {
+		return descriptor{}, "", fmt.Errorf("closing layer zipper: %s", err)
+	}
+	if err := l.file.Close(); err != nil {
+		return descriptor{}, "", fmt.Errorf("closing layer file: %s", err)
+	}
+
+	checksum := hex.EncodeToString(l.summer.Sum(nil))
+	if err := os.Rename(l.file.Name(), blobPath(checksum)); err != nil {
+		return descriptor{}, "", fmt.Errorf("moving layer into store: %s", err)
+	}
+
+	return layerDescriptor(checksum, l.counter.size), "sha256:" + hex.EncodeToString(l.uncompressedSummer.Sum(nil)), nil
+}
+
+// abort discards the layer. It is a no-op after a successful commit.
+func (l *layerWriter) abort() {
+	l.file.Close()
+	os.Remove(l.file.Name())
+}
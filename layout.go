@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The layouts a store can have on disk. Both keep records and droplets at the
+// top of the store, but an OCI store keeps its blobs in blobs/sha256 and lists
+// its manifests in index.json, so that it is also an OCI image layout that
+// tools like skopeo and umoci can read.
+const (
+	flatLayout = "flat"
+	ociLayout  = "oci"
+)
+
+// The annotations of the manifests in the index.json of an OCI store.
+const (
+	appGUIDAnnotation         = "org.cloudfoundry.app.guid"
+	dropletGUIDAnnotation     = "org.cloudfoundry.droplet.guid"
+	dropletChecksumAnnotation = "org.cloudfoundry.droplet.checksum"
+	stackAnnotation           = "org.cloudfoundry.stack"
+	createdAnnotation         = "org.opencontainers.image.created"
+)
+
+// blobPath returns where a blob is kept, by the hex of its sha256 digest.
+func (s *storeManager) blobPath(checksum string) string {
+	if s.ociLayout {
+		return filepath.Join(s.path, "blobs", "sha256", checksum)
+	}
+	return filepath.Join(s.path, checksum)
+}
+
+// storeFile is a file in the store, which is in blobs/sha256 if it is a blob
+// in an OCI store.
+type storeFile struct {
+	os.FileInfo
+	path string
+}
+
+// storeFiles lists the blobs, droplets, records and temporary files in the
+// store.
+func (s *storeManager) storeFiles() ([]storeFile, error) {
+	var files []storeFile
+	dirs := []string{s.path}
+	if s.ociLayout {
+		dirs = append(dirs, filepath.Join(s.path, "blobs", "sha256"))
+	}
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			files = append(files, storeFile{FileInfo: info, path: filepath.Join(dir, info.Name())})
+		}
+	}
+	return files, nil
+}
+
+// prepare checks that the store has the layout it is configured with,
+// refusing to use one with the other layout, and creates the files of an OCI
+// store that is new.
+func (s *storeManager) prepare() error {
+	layoutFile := filepath.Join(s.path, "oci-layout")
+	if !s.ociLayout {
+		if fileExists(layoutFile) {
+			return fmt.Errorf("store %s has the %s layout, but store.layout is %s", s.path, ociLayout, flatLayout)
+		}
+		return nil
+	}
+
+	if !fileExists(layoutFile) {
+		flatBlobs, err := filepath.Glob(filepath.Join(s.path, strings.Repeat("[0-9a-f]", 64)))
+		if err != nil {
+			return err
+		}
+		if len(flatBlobs) > 0 {
+			return fmt.Errorf("store %s has the %s layout, but store.layout is %s; run migrate-store to move it to the %s layout", s.path, flatLayout, ociLayout, ociLayout)
+		}
+	}
+	return s.migrateToOCILayout()
+}
+
+// migrateToOCILayout moves the blobs of a flat store into blobs/sha256 and
+// writes index.json and, last, oci-layout, after which the store has to be
+// used with the OCI layout. The registry mustn't be running on the store
+// meanwhile. Migrating a store that has the OCI layout already is harmless.
+func (s *storeManager) migrateToOCILayout() error {
+	s.ociLayout = true
+	blobsDir := filepath.Join(s.path, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0700); err != nil {
+		return fmt.Errorf("creating blobs directory: %s", err)
+	}
+
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Mode().IsRegular() && storeFileKindOf(file.Name()) == blobFile {
+			if err := os.Rename(filepath.Join(s.path, file.Name()), s.blobPath(file.Name())); err != nil {
+				return fmt.Errorf("moving blob %s: %s", file.Name(), err)
+			}
+		}
+	}
+
+	s.manifestsLock.Lock()
+	err = s.writeIndex()
+	s.manifestsLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(s.path, "oci-layout"), map[string]string{"imageLayoutVersion": "1.0.0"}); err != nil {
+		return fmt.Errorf("writing oci-layout: %s", err)
+	}
+	return nil
+}
+
+// writeIndex lists the manifests recorded for apps and local images in the
+// index.json of an OCI store, and does nothing in a flat one. An app's newest
+// manifest is named <app guid>:latest, and those of local images by their
+// name and tag. It must be called with manifestsLock held, after changing
+// their records.
+func (s *storeManager) writeIndex() error {
+	if !s.ociLayout {
+		return nil
+	}
+
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []ociDescriptor{}}
+	addManifest := func(manifestChecksum string, annotations map[string]string) error {
+		info, err := os.Stat(s.blobPath(manifestChecksum))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		index.Manifests = append(index.Manifests, ociDescriptor{
+			descriptor:  descriptor{MediaType: manifestMediaType, Digest: "sha256:" + manifestChecksum, Size: info.Size()},
+			Annotations: annotations,
+		})
+		return nil
+	}
+
+	recordPaths, err := filepath.Glob(s.appManifestsPath("*"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(recordPaths)
+	for _, recordPath := range recordPaths {
+		appGUID := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(recordPath), "app-"), "-manifests")
+		manifests, err := s.appManifests(appGUID)
+		if err != nil {
+			return err
+		}
+		var checksums []string
+		for manifestChecksum := range manifests.Manifests {
+			checksums = append(checksums, manifestChecksum)
+		}
+		sort.Slice(checksums, func(i, j int) bool {
+			return manifests.Manifests[checksums[i]].Created.Before(manifests.Manifests[checksums[j]].Created)
+		})
+		newest := manifests.newest()
+		for _, manifestChecksum := range checksums {
+			record := manifests.Manifests[manifestChecksum]
+			annotations := map[string]string{
+				appGUIDAnnotation:     appGUID,
+				dropletGUIDAnnotation: record.DropletGUID,
+				createdAnnotation:     record.Created.Format(time.RFC3339),
+			}
+			if manifestChecksum == newest {
+				annotations[ociRefNameKey] = appGUID + ":latest"
+			}
+			if err := addManifest(manifestChecksum, annotations); err != nil {
+				return err
+			}
+		}
+	}
+
+	recordPaths, err = filepath.Glob(s.imagePath("*"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(recordPaths)
+	for _, recordPath := range recordPaths {
+		name := strings.TrimPrefix(filepath.Base(recordPath), "image-")
+		image, err := s.image(name)
+		if err != nil {
+			return err
+		}
+		var tags []string
+		for tag := range image.Tags {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			record := image.Tags[tag]
+			manifestChecksum, err := digestHex(record.Manifest)
+			if err != nil {
+				return fmt.Errorf("image %s:%s: %s", name, tag, err)
+			}
+			annotations := map[string]string{
+				ociRefNameKey:             name + ":" + tag,
+				dropletChecksumAnnotation: strings.Replace(strings.TrimPrefix(record.Droplet, "droplet-"), "-", ":", 1),
+				stackAnnotation:           record.Stack,
+				createdAnnotation:         record.Created.Format(time.RFC3339),
+			}
+			if err := addManifest(manifestChecksum, annotations); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writeJSONFile(filepath.Join(s.path, "index.json"), index); err != nil {
+		return fmt.Errorf("writing index.json: %s", err)
+	}
+	return nil
+}
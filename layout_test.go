@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigratedStoreIsAnOCIImageLayout(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	appGUID, before, after := pullTwice(t, registry)
+	flatBlob := registry.store.blobPath(strings.TrimPrefix(after.manifest.Config.Digest, "sha256:"))
+
+	if err := registry.store.migrateToOCILayout(); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.store.migrateToOCILayout(); err != nil {
+		t.Fatalf("migrating again: %s", err)
+	}
+	if fileExists(flatBlob) || !storeHas(registry.store, after.manifest.Config.Digest) {
+		t.Errorf("blobs weren't moved into blobs/sha256")
+	}
+	var layout map[string]string
+	if err := readJSONFile(filepath.Join(registry.store.path, "oci-layout"), &layout); err != nil || layout["imageLayoutVersion"] != "1.0.0" {
+		t.Errorf("oci-layout is %v (%v)", layout, err)
+	}
+
+	var index ociIndex
+	if err := readJSONFile(filepath.Join(registry.store.path, "index.json"), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("index lists %d manifests, want 2", len(index.Manifests))
+	}
+	newest := index.Manifests[1]
+	if newest.Annotations[ociRefNameKey] != appGUID+":latest" || newest.Annotations[appGUIDAnnotation] != appGUID {
+		t.Errorf("newest manifest in the index is %+v", newest)
+	}
+	if index.Manifests[0].Annotations[ociRefNameKey] != "" {
+		t.Errorf("older manifest in the index is %+v", index.Manifests[0])
+	}
+	for i, desc := range index.Manifests {
+		m := readStoredManifest(t, registry.store, desc.Digest)
+		if want := []pulledImage{before, after}[i].manifest.Config.Digest; m.Config.Digest != want {
+			t.Errorf("manifest %d in the index has config %s, want %s", i, m.Config.Digest, want)
+		}
+		for _, blob := range append(m.Layers, m.Config) {
+			if !storeHas(registry.store, blob.Digest) {
+				t.Errorf("blob %s of %s isn't in blobs/sha256", blob.Digest, desc.Digest)
+			}
+		}
+	}
+
+	pulled := (&dockerClient{t: t, registry: registry.URL}).pull(appGUID)
+	if pulled.manifest.Config.Digest != after.manifest.Config.Digest {
+		t.Errorf("pulled config %s from the migrated store, want %s", pulled.manifest.Config.Digest, after.manifest.Config.Digest)
+	}
+	if problems, err := registry.store.fsck(); err != nil || len(problems) > 0 {
+		t.Errorf("fsck found %v (%v)", problems, err)
+	}
+
+	if _, err := registry.store.gc(0, time.Nanosecond, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := readJSONFile(filepath.Join(registry.store.path, "index.json"), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Annotations[ociRefNameKey] != appGUID+":latest" {
+		t.Errorf("after forgetting old manifests the index lists %+v", index.Manifests)
+	}
+	if storeHas(registry.store, before.manifest.Config.Digest) || !storeHas(registry.store, after.manifest.Config.Digest) {
+		t.Errorf("gc didn't collect only the forgotten manifest's blobs")
+	}
+}
+
+func TestStoresMustHaveTheConfiguredLayout(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	(&dockerClient{t: t, registry: registry.URL}).pull(registry.pushApp(t, someAppDroplet))
+
+	oci := &storeManager{path: registry.store.path, logger: registry.store.logger, ociLayout: true}
+	if err := oci.prepare(); err == nil || !strings.Contains(err.Error(), "migrate-store") {
+		t.Errorf("opening a flat store as an OCI one: %v", err)
+	}
+
+	if err := registry.store.migrateToOCILayout(); err != nil {
+		t.Fatal(err)
+	}
+	flat := &storeManager{path: registry.store.path, logger: registry.store.logger}
+	if err := flat.prepare(); err == nil {
+		t.Error("opened an OCI store as a flat one")
+	}
+	if err := oci.prepare(); err != nil {
+		t.Errorf("opening a migrated store: %s", err)
+	}
+
+	empty := &storeManager{path: filepath.Join(t.TempDir(), "store"), logger: registry.store.logger, ociLayout: true}
+	if err := empty.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(empty.path, "oci-layout")) || !fileExists(filepath.Join(empty.path, "index.json")) {
+		t.Error("a new OCI store has no oci-layout or index.json")
+	}
+}
+
+func TestFsckOnlyFindsBlobsWhereTheyAreRead(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	image := (&dockerClient{t: t, registry: registry.URL}).pull(registry.pushApp(t, someAppDroplet))
+	if err := registry.store.migrateToOCILayout(); err != nil {
+		t.Fatal(err)
+	}
+	config := strings.TrimPrefix(image.manifest.Config.Digest, "sha256:")
+	if err := os.Rename(registry.store.blobPath(config), filepath.Join(registry.store.path, config)); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := registry.store.fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 || !strings.HasPrefix(problems[0], "blob "+config+" is missing") || problems[1] != "unexpected file "+config {
+		t.Errorf("fsck of an OCI store with a blob at the top level found %v", problems)
+	}
+}
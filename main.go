@@ -1,50 +1,120 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
 )
 
 func main() {
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	runCommand(name, args)
+}
+
+func serve(cfg *config) {
 	logger := log.New(os.Stdout, "[spikistry] ", log.LstdFlags)
 	logger.Println("a very spiky registry")
 
-	store := flag.String("store", "", "store")
-	listenAddress := flag.String("listen-address", "", "listen-address")
-	rootfsPath := flag.String("rootfs-path", "", "rootfs")
-	capiURL := flag.String("capi-url", "", "capi-url")
-	capiAuthToken := flag.String("capi-authtoken", "", "capi-authtoken")
-	flag.Parse()
+	var err error
+	httpClient, err = newHTTPClient(clientTLSOptions{
+		caCertPath:     cfg.CFTLS.CACert,
+		clientCertPath: cfg.CFTLS.ClientCert,
+		clientKeyPath:  cfg.CFTLS.ClientKey,
+		skipVerify:     cfg.CFTLS.SkipVerify,
+	})
+	must("configure TLS", err)
+	if cfg.CFTLS.SkipVerify {
+		logger.Println("WARNING: not verifying TLS certificates of CAPI, UAA and blobstores")
+	}
 
-	if *store == "" {
-		panic("please set --store")
+	storeMgr := openStore(cfg, logger)
+	storeMgr.capi = &capi.Client{
+		URL:        cfg.CAPI.URL,
+		Token:      cfg.CAPI.AuthToken, // "bearer" is already prefixed in the result of `cf oauth-token`
+		HTTPClient: httpClient,
 	}
-	if *rootfsPath == "" {
-		panic("please set --rootfs-path")
+	must("load stacks", storeMgr.loadStacks())
+	for stack, rootfsPath := range cfg.Stacks {
+		must("import rootfs", storeMgr.importRootfs(stack, rootfsPath))
 	}
-	if *capiURL == "" {
-		panic("please set --capi-url")
+	if len(storeMgr.stacks) == 0 {
+		must("load stacks", fmt.Errorf("no stack has a rootfs; set stacks, --rootfs-path or %s, or run import-rootfs", rootfsPathEnv))
 	}
-	if *capiAuthToken == "" {
-		panic("please set --capi-authtoken")
+
+	var auth *tokenAuth
+	if cfg.UAA.URL != "" {
+		uaa := &uaaClient{url: cfg.UAA.URL, clientID: cfg.UAA.ClientID, clientSecret: cfg.UAA.ClientSecret}
+		auth = newTokenAuth(uaa, storeMgr, cfg.Auth.TokenSecret, cfg.CAPI.UseCallerIdentity)
 	}
 
-	storeMgr := &storeManager{
-		path:          *store,
-		capiURL:       *capiURL,
-		capiAuthToken: *capiAuthToken,
-		logger:        logger,
+	if cfg.AdminListenAddress != "" {
+		go NewAdminAPI(cfg.AdminListenAddress, storeMgr, cfg.pushCredentials()).ListenAndServe()
+	}
+	blobURLs := newBlobURLs(cfg.Blobs.URLSecret, cfg.Blobs.BaseURL)
+	registryAPI := NewAPI(cfg.ListenAddress, storeMgr, auth, blobURLs)
+	var blobServer *blobAPI
+	if cfg.Blobs.ListenAddress != "" {
+		blobServer = NewBlobAPI(cfg.Blobs.ListenAddress, storeMgr, blobURLs)
+	}
+	if cfg.TLS.Cert == "" {
+		if blobServer != nil {
+			go blobServer.ListenAndServe()
+		}
+		registryAPI.ListenAndServe()
+		return
+	}
+	certs, err := newCertReloader(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.ClientCA, logger)
+	must("load TLS certificates", err)
+	if blobServer != nil {
+		go blobServer.ListenAndServeTLS(certs)
 	}
-	storeMgr.importRootfs(*rootfsPath)
+	registryAPI.ListenAndServeTLS(certs)
+}
+
+// defaultStack is the stack that a --rootfs-path without a stack name is
+// imported for.
+const defaultStack = "cflinuxfs2"
+
+// stackPaths collects repeated --rootfs-path flags, keyed by stack name.
+type stackPaths map[string]string
 
-	NewAPI(*listenAddress, storeMgr).ListenAndServe()
+func (p stackPaths) String() string {
+	var pairs []string
+	for stack, path := range p {
+		pairs = append(pairs, stack+"="+path)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p stackPaths) Set(value string) error {
+	stack, path := defaultStack, value
+	if parts := strings.SplitN(value, "=", 2); len(parts) == 2 {
+		stack, path = parts[0], parts[1]
+	}
+	if stack == "" || path == "" {
+		return fmt.Errorf("expected <stack>=<path>, got %q", value)
+	}
+	if _, ok := p[stack]; ok {
+		return fmt.Errorf("rootfs for stack %s given more than once", stack)
+	}
+	p[stack] = path
+	return nil
 }
 
 func must(action string, err error) {
 	if err != nil {
-		fmt.Printf("error %s: %s", action, err)
+		fmt.Printf("error %s: %s\n", action, err)
 		os.Exit(1)
 	}
 }
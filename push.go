@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// remoteReference is where an image is pushed: a repository and tag in a
+// registry that implements the Distribution spec.
+type remoteReference struct {
+	// registry is the scheme and host of the registry, e.g.
+	// https://registry.example.com.
+	registry   string
+	repository string
+	tag        string
+}
+
+func (r remoteReference) String() string {
+	return strings.TrimPrefix(r.registry, "https://") + "/" + r.repository + ":" + r.tag
+}
+
+func (r remoteReference) host() string {
+	return r.registry[strings.Index(r.registry, "://")+3:]
+}
+
+var repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+
+// parseRemoteReference parses a destination like
+// registry.example.com/team/app:1.2.3, whose tag is latest if it has none.
+// The registry is reached over https, unless the destination starts with
+// http://.
+func parseRemoteReference(dest string) (remoteReference, error) {
+	scheme, rest := "https", dest
+	if i := strings.Index(dest, "://"); i >= 0 {
+		scheme, rest = dest[:i], dest[i+3:]
+	}
+	slash := strings.Index(rest, "/")
+	if (scheme != "https" && scheme != "http") || slash <= 0 {
+		return remoteReference{}, fmt.Errorf("invalid destination %q: expected <registry host>/<repository>[:<tag>]", dest)
+	}
+
+	ref := remoteReference{registry: scheme + "://" + rest[:slash], repository: rest[slash+1:], tag: "latest"}
+	if i := strings.LastIndex(ref.repository, ":"); i >= 0 {
+		ref.repository, ref.tag = ref.repository[:i], ref.repository[i+1:]
+	}
+	if !repositoryPattern.MatchString(ref.repository) {
+		return remoteReference{}, fmt.Errorf("invalid repository %q: expected lowercase letters, digits and separators", ref.repository)
+	}
+	if !imageTagPattern.MatchString(ref.tag) {
+		return remoteReference{}, fmt.Errorf("invalid image tag %q", ref.tag)
+	}
+	return ref, nil
+}
+
+// registryCredentials are what the registry authenticates to the registry at
+// host with when it pushes there. Registries that allow anonymous pushes need
+// none.
+type registryCredentials struct {
+	host     string
+	username string
+	password string
+}
+
+// forHost returns the credentials if they are for host, and none otherwise,
+// so that they are never sent to any other registry.
+func (c registryCredentials) forHost(host string) registryCredentials {
+	if c.host != host {
+		return registryCredentials{}
+	}
+	return c
+}
+
+// registryClient makes requests to a Distribution-spec registry,
+// authenticating the way its /v2/ endpoint asks to be: with basic auth, or
+// with a bearer token from its token service.
+type registryClient struct {
+	url           string
+	credentials   registryCredentials
+	authorization string
+}
+
+var authParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// login finds out how the registry authenticates requests, getting a token
+// for scopes if it uses bearer tokens.
+func (c *registryClient) login(scopes []string) error {
+	response, err := c.do("GET", c.url+"/v2/", nil, 0, "")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+	default:
+		return fmt.Errorf("registry %s answered /v2/ with %s", c.url, response.Status)
+	}
+
+	challenge := response.Header.Get("WWW-Authenticate")
+	params := map[string]string{}
+	for _, match := range authParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	switch strings.ToLower(strings.SplitN(challenge, " ", 2)[0]) {
+	case "basic":
+		if c.credentials.username == "" {
+			return fmt.Errorf("registry %s requires a username and password; set --push-registry, --push-username and --push-password", c.url)
+		}
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.credentials.username+":"+c.credentials.password))
+		return nil
+	case "bearer":
+		return c.fetchToken(params["realm"], params["service"], scopes)
+	}
+	return fmt.Errorf("registry %s asks for unsupported authentication %q", c.url, challenge)
+}
+
+// fetchToken gets a bearer token from a registry's token service, as the
+// registry's user if there are credentials and anonymously otherwise.
+func (c *registryClient) fetchToken(realm, service string, scopes []string) error {
+	realmURL, err := url.Parse(realm)
+	if err != nil || realmURL.Host == "" {
+		return fmt.Errorf("registry %s has an invalid token realm %q", c.url, realm)
+	}
+	query := realmURL.Query()
+	if service != "" {
+		query.Set("service", service)
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+	realmURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequest("GET", realmURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.credentials.username != "" {
+		request.SetBasicAuth(c.credentials.username, c.credentials.password)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("getting a token for registry %s: %s", c.url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return remoteRegistryError(fmt.Sprintf("getting a token for registry %s", c.url), response)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return fmt.Errorf("decoding token for registry %s: %s", c.url, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("the token service of registry %s returned no token", c.url)
+	}
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// do makes a request, authenticating it if it is to the registry rather than,
+// say, a storage backend an upload location points at.
+func (c *registryClient) do(method, requestURL string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	request, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.ContentLength = size
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if registryURL, err := url.Parse(c.url); err == nil && request.URL.Host == registryURL.Host && c.authorization != "" {
+		request.Header.Set("Authorization", c.authorization)
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("contacting registry %s: %s", c.url, err)
+	}
+	return response, nil
+}
+
+// remoteRegistryError describes a failed request, including the start of the
+// registry's response, which usually holds its error codes.
+func remoteRegistryError(action string, response *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+	if len(body) == 0 {
+		return fmt.Errorf("%s: registry answered %s", action, response.Status)
+	}
+	return fmt.Errorf("%s: registry answered %s: %s", action, response.Status, strings.TrimSpace(string(body)))
+}
+
+// pushedBlobs records, as pushed-<registry host>, which repository of a
+// registry the store's rootfs layers were last pushed to, so that pushes to
+// other repositories can mount them from there rather than uploading them
+// again.
+type pushedBlobs struct {
+	Repositories map[string]string `json:"repositories"`
+}
+
+func (s *storeManager) pushedBlobsPath(host string) string {
+	return filepath.Join(s.path, "pushed-"+host)
+}
+
+// pushReport describes how each blob of a pushed image got to the registry.
+type pushReport struct {
+	Destination string   `json:"destination"`
+	Digest      string   `json:"digest"`
+	Uploaded    []string `json:"uploaded"`
+	Mounted     []string `json:"mounted"`
+	Existing    []string `json:"existing"`
+}
+
+// PushImage pushes an image in the store, referred to as export refers to
+// them, to a repository of another registry, authenticating with credentials
+// only if they are for its host. Blobs the repository has already are
+// skipped, and rootfs layers pushed to another of the registry's
+// repositories before are mounted from there. The manifest is pushed as it
+// is in the store, so its digest is the same.
+func (s *storeManager) PushImage(ref, destination string, credentials registryCredentials) (pushReport, error) {
+	dest, err := parseRemoteReference(destination)
+	if err != nil {
+		return pushReport{}, err
+	}
+	image, err := s.resolveImage(ref)
+	if err != nil {
+		return pushReport{}, err
+	}
+	manifestJson, err := ioutil.ReadFile(s.blobPath(image.manifestChecksum))
+	if err != nil {
+		return pushReport{}, fmt.Errorf("reading manifest sha256:%s: %s", image.manifestChecksum, err)
+	}
+
+	s.logger.Printf("pushing %s to %s...", ref, dest)
+	defer s.logger.Printf("done pushing %s to %s", ref, dest)
+
+	var pushed pushedBlobs
+	if err := readJSONFile(s.pushedBlobsPath(dest.host()), &pushed); err != nil && !os.IsNotExist(err) {
+		return pushReport{}, fmt.Errorf("reading blobs pushed to %s: %s", dest.host(), err)
+	}
+	rootfsLayers := s.rootfsLayers()
+	scopes := []string{"repository:" + dest.repository + ":pull,push"}
+	mountFrom := map[string]string{}
+	for _, layer := range image.manifest.Layers {
+		if from := pushed.Repositories[layer.Digest]; rootfsLayers[layer.Digest] && from != "" && from != dest.repository {
+			mountFrom[layer.Digest] = from
+			scopes = append(scopes, "repository:"+from+":pull")
+		}
+	}
+	sort.Strings(scopes[1:])
+
+	client := &registryClient{url: dest.registry, credentials: credentials.forHost(dest.host())}
+	if err := client.login(scopes); err != nil {
+		return pushReport{}, err
+	}
+
+	report := pushReport{Destination: dest.String(), Digest: "sha256:" + image.manifestChecksum}
+	for _, desc := range append(append([]descriptor{}, image.manifest.Layers...), image.manifest.Config) {
+		outcome, err := s.pushBlob(client, dest, desc, mountFrom[desc.Digest])
+		if err != nil {
+			return pushReport{}, err
+		}
+		switch outcome {
+		case blobUploaded:
+			report.Uploaded = append(report.Uploaded, desc.Digest)
+		case blobMounted:
+			report.Mounted = append(report.Mounted, desc.Digest)
+		case blobExisting:
+			report.Existing = append(report.Existing, desc.Digest)
+		}
+	}
+
+	manifestURL := dest.registry + "/v2/" + dest.repository + "/manifests/" + dest.tag
+	response, err := client.do("PUT", manifestURL, bytes.NewReader(manifestJson), int64(len(manifestJson)), image.manifest.MediaType)
+	if err != nil {
+		return pushReport{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return pushReport{}, remoteRegistryError("pushing manifest", response)
+	}
+	if digest := response.Header.Get("Docker-Content-Digest"); digest != "" && digest != report.Digest {
+		return pushReport{}, fmt.Errorf("registry stored the manifest as %s, not %s", digest, report.Digest)
+	}
+
+	if err := s.recordPushedLayers(dest, image.manifest.Layers, rootfsLayers); err != nil {
+		return pushReport{}, err
+	}
+	return report, nil
+}
+
+// The ways pushBlob gets a blob to a registry.
+const (
+	blobExisting = "existing"
+	blobMounted  = "mounted"
+	blobUploaded = "uploaded"
+)
+
+// pushBlob makes sure a repository has a blob: skipping it if it has it
+// already, mounting it from another repository of the registry if from is
+// set and the registry allows it, or uploading it.
+func (s *storeManager) pushBlob(client *registryClient, dest remoteReference, desc descriptor, from string) (string, error) {
+	blobsURL := dest.registry + "/v2/" + dest.repository + "/blobs/"
+	response, err := client.do("HEAD", blobsURL+desc.Digest, nil, 0, "")
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		return blobExisting, nil
+	}
+
+	uploadsURL := blobsURL + "uploads/"
+	if from != "" {
+		uploadsURL += "?" + url.Values{"mount": {desc.Digest}, "from": {from}}.Encode()
+	}
+	response, err = client.do("POST", uploadsURL, nil, 0, "")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	switch {
+	case response.StatusCode == http.StatusCreated && from != "":
+		return blobMounted, nil
+	case response.StatusCode != http.StatusAccepted:
+		return "", remoteRegistryError("starting upload of blob "+desc.Digest, response)
+	}
+	location, err := response.Location()
+	if err != nil {
+		return "", fmt.Errorf("starting upload of blob %s: %s", desc.Digest, err)
+	}
+	query := location.Query()
+	query.Set("digest", desc.Digest)
+	location.RawQuery = query.Encode()
+
+	checksum, err := digestHex(desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	blob, err := s.OpenBlob(checksum)
+	if err != nil {
+		return "", fmt.Errorf("opening blob %s: %s", desc.Digest, err)
+	}
+	defer blob.Close()
+	response, err = client.do("PUT", location.String(), blob, desc.Size, "application/octet-stream")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return "", remoteRegistryError("uploading blob "+desc.Digest, response)
+	}
+	return blobUploaded, nil
+}
+
+// rootfsLayers returns the digests of the layers of every stack's rootfs.
+func (s *storeManager) rootfsLayers() map[string]bool {
+	s.stacksLock.RLock()
+	defer s.stacksLock.RUnlock()
+
+	layers := map[string]bool{}
+	for _, rootfs := range s.stacks {
+		for _, layer := range rootfs.layers {
+			layers[layer.Digest] = true
+		}
+	}
+	return layers
+}
+
+// recordPushedLayers records that a repository has the rootfs layers among
+// layers, for later pushes to mount them from.
+func (s *storeManager) recordPushedLayers(dest remoteReference, layers []descriptor, rootfsLayers map[string]bool) error {
+	s.pushesLock.Lock()
+	defer s.pushesLock.Unlock()
+
+	var pushed pushedBlobs
+	if err := readJSONFile(s.pushedBlobsPath(dest.host()), &pushed); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading blobs pushed to %s: %s", dest.host(), err)
+	}
+	if pushed.Repositories == nil {
+		pushed.Repositories = map[string]string{}
+	}
+	for _, layer := range layers {
+		if rootfsLayers[layer.Digest] {
+			pushed.Repositories[layer.Digest] = dest.repository
+		}
+	}
+	if err := writeJSONFile(s.pushedBlobsPath(dest.host()), pushed); err != nil {
+		return fmt.Errorf("recording blobs pushed to %s: %s", dest.host(), err)
+	}
+	return nil
+}
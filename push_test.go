@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/masters-of-cats/droplet-registry-spike/fakecf"
+	"github.com/pborman/uuid"
+)
+
+// fakeDistribution is a stand-in for a Distribution-spec registry, keeping
+// blobs and manifests in memory. With bearer set it authenticates requests
+// with tokens from its /token endpoint, which grant the scopes asked for, and
+// otherwise with basic auth. With anonymous set it takes requests without
+// credentials, and refuses any that have them. Blobs are only mounted from
+// repositories the token grants pulls of.
+type fakeDistribution struct {
+	*httptest.Server
+	bearer, anonymous  bool
+	username, password string
+
+	lock      sync.Mutex
+	tokens    map[string][]string
+	blobs     map[string]map[string][]byte
+	manifests map[string][]byte
+	uploads   map[string]string
+	mounts    int
+}
+
+func newFakeDistribution(t *testing.T, bearer bool) *fakeDistribution {
+	d := &fakeDistribution{
+		bearer:    bearer,
+		username:  "pusher",
+		password:  "pusher-password",
+		tokens:    map[string][]string{},
+		blobs:     map[string]map[string][]byte{},
+		manifests: map[string][]byte{},
+		uploads:   map[string]string{},
+	}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(d.Close)
+	return d
+}
+
+var fakeDistributionPath = regexp.MustCompile(`^/v2/(.+?)/(blobs/uploads/|blobs/|manifests/|uploads/)([^/]*)$`)
+
+func (d *fakeDistribution) serve(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if r.URL.Path == "/token" {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != d.username || password != d.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token := uuid.New()
+		d.tokens[token] = r.URL.Query()["scope"]
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+		return
+	}
+
+	scopes, ok := d.authenticate(r)
+	if !ok {
+		if d.bearer {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, d.URL))
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	match := fakeDistributionPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	repository, kind, rest := match[1], match[2], match[3]
+	if d.bearer && !scopes["repository:"+repository+":pull,push"] {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if d.blobs[repository] == nil {
+		d.blobs[repository] = map[string][]byte{}
+	}
+
+	switch {
+	case kind == "blobs/" && r.Method == "HEAD":
+		if d.blobs[repository][rest] == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	case kind == "blobs/uploads/" && r.Method == "POST":
+		digest, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from")
+		if blob := d.blobs[from][digest]; blob != nil && (!d.bearer || scopes["repository:"+from+":pull"]) {
+			d.blobs[repository][digest] = blob
+			d.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		id := uuid.New()
+		d.uploads[id] = repository
+		w.Header().Set("Location", "/v2/"+repository+"/uploads/"+id+"?state=abc")
+		w.WriteHeader(http.StatusAccepted)
+
+	case kind == "uploads/" && r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		if d.uploads[rest] != repository || r.URL.Query().Get("state") != "abc" || r.URL.Query().Get("digest") != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(d.uploads, rest)
+		d.blobs[repository][digest] = body
+		w.WriteHeader(http.StatusCreated)
+
+	case kind == "manifests/" && r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		var m manifest
+		if err := json.Unmarshal(body, &m); err != nil || r.Header.Get("Content-Type") != m.MediaType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, desc := range append(m.Layers, m.Config) {
+			if d.blobs[repository][desc.Digest] == nil {
+				http.Error(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`, http.StatusBadRequest)
+				return
+			}
+		}
+		d.manifests[repository+":"+rest] = body
+		w.Header().Set("Docker-Content-Digest", "sha256:"+checksumOf(body))
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *fakeDistribution) authenticate(r *http.Request) (map[string]bool, bool) {
+	authorization := r.Header.Get("Authorization")
+	if d.anonymous {
+		return nil, authorization == ""
+	}
+	if !d.bearer {
+		username, password, ok := r.BasicAuth()
+		return nil, ok && username == d.username && password == d.password
+	}
+	scopes, ok := d.tokens[strings.TrimPrefix(authorization, "Bearer ")]
+	granted := map[string]bool{}
+	for _, scope := range scopes {
+		granted[scope] = true
+	}
+	return granted, ok
+}
+
+func (d *fakeDistribution) host() string {
+	return strings.TrimPrefix(d.URL, "http://")
+}
+
+func sortedDigests(descs []descriptor) []string {
+	var digests []string
+	for _, desc := range descs {
+		digests = append(digests, desc.Digest)
+	}
+	sort.Strings(digests)
+	return digests
+}
+
+func TestPushUploadsMissingBlobsAndMountsRootfs(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	remote := newFakeDistribution(t, true)
+	credentials := registryCredentials{host: remote.host(), username: remote.username, password: remote.password}
+	client := &dockerClient{t: t, registry: registry.URL}
+	firstApp := registry.pushApp(t, someAppDroplet)
+	first := client.pull(firstApp)
+	otherDroplet := fakecf.Droplet{Stack: defaultStack, Files: []fakecf.File{{Name: "app/server.rb", Contents: "puts 'other app'"}}}
+	secondApp := registry.pushApp(t, otherDroplet)
+	second := client.pull(secondApp)
+
+	report, err := registry.store.PushImage(firstApp, "http://"+remote.host()+"/team/first:1.0", credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Uploaded) != len(first.manifest.Layers)+1 || len(report.Mounted)+len(report.Existing) != 0 {
+		t.Errorf("first push: %+v", report)
+	}
+	stored := readStoredManifest(t, registry.store, report.Digest)
+	if pushed := remote.manifests["team/first:1.0"]; "sha256:"+checksumOf(pushed) != report.Digest || stored.Config.Digest != first.manifest.Config.Digest {
+		t.Errorf("registry has manifest %s, pushed %s", pushed, report.Digest)
+	}
+
+	report, err = registry.store.PushImage(secondApp, "http://"+remote.host()+"/team/second", credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfs := sortedDigests(registry.store.stackRootfs(defaultStack).layers)
+	sort.Strings(report.Mounted)
+	if strings.Join(report.Mounted, ",") != strings.Join(rootfs, ",") || remote.mounts != len(rootfs) {
+		t.Errorf("second push mounted %v, want the rootfs layers %v", report.Mounted, rootfs)
+	}
+	if len(report.Uploaded) != len(second.manifest.Layers)+1-len(rootfs) {
+		t.Errorf("second push uploaded %v", report.Uploaded)
+	}
+	if remote.manifests["team/second:latest"] == nil {
+		t.Error("second push has no latest tag")
+	}
+
+	report, err = registry.store.PushImage(firstApp, "http://"+remote.host()+"/team/first:1.1", credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Existing) != len(first.manifest.Layers)+1 || len(report.Uploaded)+len(report.Mounted) != 0 {
+		t.Errorf("pushing again: %+v", report)
+	}
+}
+
+func TestPushWithBasicAuthThroughTheAdminAPI(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	remote := newFakeDistribution(t, false)
+	appGUID := registry.pushApp(t, someAppDroplet)
+	(&dockerClient{t: t, registry: registry.URL}).pull(appGUID)
+	configured := registryCredentials{host: "registry.example.com", username: remote.username, password: remote.password}
+	admin := httptest.NewServer(NewAdminAPI("127.0.0.1:0", registry.store, configured))
+	defer admin.Close()
+
+	push := func(request pushImageRequest) (int, string) {
+		body, _ := json.Marshal(request)
+		response, err := http.Post(admin.URL+"/admin/push", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		contents, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(contents)
+	}
+
+	request := pushImageRequest{Image: appGUID, Destination: "http://" + remote.host() + "/my-app:1.0"}
+	if status, body := push(request); status != http.StatusUnprocessableEntity || !strings.Contains(body, "requires a username") {
+		t.Errorf("push to a registry without configured credentials: %d %s", status, body)
+	}
+	if _, err := registry.store.PushImage(appGUID, request.Destination, configured); err == nil || !strings.Contains(err.Error(), "requires a username") {
+		t.Errorf("credentials for another registry were used: %v", err)
+	}
+
+	request.Username, request.Password = remote.username, "wrong"
+	if status, body := push(request); status != http.StatusUnprocessableEntity || !strings.Contains(body, "401") {
+		t.Errorf("push with the wrong password: %d %s", status, body)
+	}
+
+	request.Username, request.Password = remote.username, remote.password
+	status, body := push(request)
+	if status != http.StatusOK {
+		t.Fatalf("push: %d %s", status, body)
+	}
+	var report pushReport
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Destination != "http://"+remote.host()+"/my-app:1.0" || remote.manifests["my-app:1.0"] == nil {
+		t.Errorf("pushed %+v", report)
+	}
+}
+
+func TestAnonymousPushThroughTheAdminAPI(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	remote := newFakeDistribution(t, false)
+	remote.anonymous = true
+	appGUID := registry.pushApp(t, someAppDroplet)
+	pulled := (&dockerClient{t: t, registry: registry.URL}).pull(appGUID)
+	configured := registryCredentials{host: "registry.example.com", username: "pusher", password: "pusher-password"}
+	admin := httptest.NewServer(NewAdminAPI("127.0.0.1:0", registry.store, configured))
+	defer admin.Close()
+
+	body, _ := json.Marshal(pushImageRequest{Image: appGUID, Destination: "http://" + remote.host() + "/my-app:1.0"})
+	response, err := http.Post(admin.URL+"/admin/push", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		contents, _ := ioutil.ReadAll(response.Body)
+		t.Fatalf("anonymous push: %s %s", response.Status, contents)
+	}
+	var report pushReport
+	if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Uploaded) != len(pulled.manifest.Layers)+1 || remote.manifests["my-app:1.0"] == nil {
+		t.Errorf("pushed %+v", report)
+	}
+}
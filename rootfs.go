@@ -0,0 +1,621 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	ociManifestMediaType          = "application/vnd.oci.image.manifest.v1+json"
+	ociLayerMediaType             = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociUncompressedLayerMediaType = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// stackRootfs is the base of the image for apps running on a particular
+// stack. It has more than one layer when it was imported from an image.
+type stackRootfs struct {
+	layers  []descriptor
+	diffIDs []string
+	vcapUID int
+	vcapGID int
+}
+
+// stackRecord persists the rootfs imported for a stack in the store, as
+// stack-<name>, so that it is still served after a restart and can be
+// imported offline by import-rootfs.
+type stackRecord struct {
+	Layers   []descriptor `json:"layers"`
+	DiffIDs  []string     `json:"diff_ids"`
+	VcapUID  int          `json:"vcap_uid"`
+	VcapGID  int          `json:"vcap_gid"`
+	Source   string       `json:"source"`
+	Imported time.Time    `json:"imported"`
+}
+
+// stackNamePattern keeps stack names usable in store file names.
+var stackNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// importRootfs imports the base layers for a stack from a gzipped tarball, an
+// unpacked directory, an OCI image layout directory, or a docker-archive
+// tarball as written by `docker save`.
+func (s *storeManager) importRootfs(stack, source string) error {
+	if !stackNamePattern.MatchString(stack) {
+		return fmt.Errorf("invalid stack name %q", stack)
+	}
+
+	s.logger.Printf("importing %s rootfs from %s...", stack, source)
+	defer s.logger.Printf("done importing %s rootfs from %s", stack, source)
+
+	if err := os.MkdirAll(s.path, 0700); err != nil {
+		return fmt.Errorf("creating store: %s", err)
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("stat rootfs: %s", err)
+	}
+
+	var rootfs *stackRootfs
+	switch {
+	case info.IsDir() && fileExists(filepath.Join(source, "oci-layout")):
+		rootfs, err = s.importOCILayout(source)
+	case info.IsDir():
+		rootfs, err = s.importRootfsDirectory(source)
+	default:
+		rootfs, err = s.importRootfsFile(source)
+	}
+	if err != nil {
+		return fmt.Errorf("importing %s rootfs from %s: %s", stack, source, err)
+	}
+
+	s.logger.Println("looking up vcap user in rootfs...")
+	rootfs.vcapUID, rootfs.vcapGID, err = s.lookupVcapUser(rootfs.layers)
+	if err != nil {
+		return fmt.Errorf("importing %s rootfs from %s: %s", stack, source, err)
+	}
+
+	if absSource, err := filepath.Abs(source); err == nil {
+		source = absSource
+	}
+	record := stackRecord{
+		Layers:   rootfs.layers,
+		DiffIDs:  rootfs.diffIDs,
+		VcapUID:  rootfs.vcapUID,
+		VcapGID:  rootfs.vcapGID,
+		Source:   source,
+		Imported: time.Now().UTC(),
+	}
+	if err := writeJSONFile(s.stackRecordPath(stack), record); err != nil {
+		return fmt.Errorf("recording %s rootfs: %s", stack, err)
+	}
+
+	s.stacksLock.Lock()
+	defer s.stacksLock.Unlock()
+	if s.stacks == nil {
+		s.stacks = map[string]*stackRootfs{}
+	}
+	s.stacks[stack] = rootfs
+	return nil
+}
+
+// stackRootfs returns the current rootfs of a stack, or nil if none has been
+// imported.
+func (s *storeManager) stackRootfs(stack string) *stackRootfs {
+	s.stacksLock.RLock()
+	defer s.stacksLock.RUnlock()
+	return s.stacks[stack]
+}
+
+func (s *storeManager) stackRecordPath(stack string) string {
+	return filepath.Join(s.path, "stack-"+stack)
+}
+
+// loadStacks loads the rootfs of every stack imported into the store before,
+// whether by import-rootfs, the admin API or an earlier run of the registry.
+func (s *storeManager) loadStacks() error {
+	recordPaths, err := filepath.Glob(s.stackRecordPath("*"))
+	if err != nil {
+		return err
+	}
+
+	s.stacksLock.Lock()
+	defer s.stacksLock.Unlock()
+	if s.stacks == nil {
+		s.stacks = map[string]*stackRootfs{}
+	}
+	for _, recordPath := range recordPaths {
+		stack := strings.TrimPrefix(filepath.Base(recordPath), "stack-")
+		var record stackRecord
+		if err := readJSONFile(recordPath, &record); err != nil {
+			return fmt.Errorf("reading %s rootfs record: %s", stack, err)
+		}
+		s.stacks[stack] = &stackRootfs{layers: record.Layers, diffIDs: record.DiffIDs, vcapUID: record.VcapUID, vcapGID: record.VcapGID}
+		s.logger.Printf("loaded %s rootfs imported from %s at %s", stack, record.Source, record.Imported.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (s *storeManager) importRootfsFile(rootfsPath string) (*stackRootfs, error) {
+	rootfsFile, err := os.Open(rootfsPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening rootfs: %s", err)
+	}
+	defer rootfsFile.Close()
+
+	gzipped, err := isGzipped(bufio.NewReader(rootfsFile))
+	if err != nil {
+		return nil, fmt.Errorf("reading rootfs: %s", err)
+	}
+	if _, err := rootfsFile.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("seeking rootfs back to 0: %s", err)
+	}
+
+	if gzipped {
+		return s.importRootfsTarball(rootfsFile)
+	}
+	return s.importDockerArchive(rootfsPath)
+}
+
+func (s *storeManager) importRootfsTarball(rootfsFile *os.File) (*stackRootfs, error) {
+	s.logger.Println("calculating rootfs compressed and uncompressed checksums...")
+	checksum, diffID, size, err := checksumGzippedLayer(rootfsFile)
+	if err != nil {
+		return nil, err
+	}
+	rootfs := &stackRootfs{layers: []descriptor{layerDescriptor(checksum, size)}, diffIDs: []string{diffID}}
+
+	if fileExists(s.blobPath(checksum)) {
+		s.logger.Println("rootfs already cached")
+		// Touched so that gc treats it as new even if it wasn't referenced.
+		now := time.Now()
+		return rootfs, os.Chtimes(s.blobPath(checksum), now, now)
+	}
+	s.logger.Println("rootfs not cached, copying into store")
+
+	if _, err := rootfsFile.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("seeking rootfs back to 0: %s", err)
+	}
+	if _, _, err := s.importBlob(rootfsFile); err != nil {
+		return nil, err
+	}
+	return rootfs, nil
+}
+
+// importRootfsDirectory tars and gzips an unpacked rootfs into a single layer.
+func (s *storeManager) importRootfsDirectory(dir string) (*stackRootfs, error) {
+	s.logger.Println("archiving rootfs directory...")
+	layer, err := newLayerWriter(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer layer.abort()
+
+	hardlinks := map[string]string{}
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		var linkname string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if linkname, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, linkname)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		// Access and change times would make the layer differ on every import.
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+
+		if key, ok := inodeKey(info); ok && info.Mode().IsRegular() {
+			if target, seen := hardlinks[key]; seen {
+				header.Typeflag, header.Linkname, header.Size = tar.TypeLink, target, 0
+			} else {
+				hardlinks[key] = header.Name
+			}
+		}
+
+		if err := layer.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(layer, file)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("archiving rootfs directory: %s", err)
+	}
+
+	desc, diffID, err := layer.commit(s.blobPath)
+	if err != nil {
+		return nil, err
+	}
+	return &stackRootfs{layers: []descriptor{desc}, diffIDs: []string{diffID}}, nil
+}
+
+// importOCILayout imports the layers of the only image in an OCI image layout
+// as they are, taking their diff IDs from the image config.
+func (s *storeManager) importOCILayout(dir string) (*stackRootfs, error) {
+	var index struct {
+		Manifests []descriptor `json:"manifests"`
+	}
+	if err := readJSONFile(filepath.Join(dir, "index.json"), &index); err != nil {
+		return nil, fmt.Errorf("reading OCI index: %s", err)
+	}
+	if len(index.Manifests) != 1 {
+		return nil, fmt.Errorf("OCI layout has %d images, expected exactly one", len(index.Manifests))
+	}
+	if mediaType := index.Manifests[0].MediaType; mediaType != ociManifestMediaType && mediaType != manifestMediaType {
+		return nil, fmt.Errorf("OCI layout image has unsupported media type %s", mediaType)
+	}
+
+	ociBlobPath := func(digest string) (string, error) {
+		checksum, err := digestHex(digest)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "blobs", "sha256", checksum), nil
+	}
+
+	manifestPath, err := ociBlobPath(index.Manifests[0].Digest)
+	if err != nil {
+		return nil, err
+	}
+	var imageManifest manifest
+	if err := readJSONFile(manifestPath, &imageManifest); err != nil {
+		return nil, fmt.Errorf("reading OCI image manifest: %s", err)
+	}
+	configPath, err := ociBlobPath(imageManifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var config imageConfig
+	if err := readJSONFile(configPath, &config); err != nil {
+		return nil, fmt.Errorf("reading OCI image config: %s", err)
+	}
+	if len(config.Rootfs.DiffIDs) != len(imageManifest.Layers) {
+		return nil, fmt.Errorf("OCI image has %d layers but %d diff IDs", len(imageManifest.Layers), len(config.Rootfs.DiffIDs))
+	}
+
+	rootfs := &stackRootfs{diffIDs: config.Rootfs.DiffIDs}
+	for _, layer := range imageManifest.Layers {
+		mediaType, err := dockerLayerMediaType(layer.MediaType)
+		if err != nil {
+			return nil, err
+		}
+		layerPath, err := ociBlobPath(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layerFile, err := os.Open(layerPath)
+		if err != nil {
+			return nil, fmt.Errorf("opening OCI layer: %s", err)
+		}
+		checksum, size, err := s.importBlob(layerFile)
+		layerFile.Close()
+		if err != nil {
+			return nil, err
+		}
+		if "sha256:"+checksum != layer.Digest {
+			return nil, fmt.Errorf("OCI layer %s has digest sha256:%s", layer.Digest, checksum)
+		}
+		rootfs.layers = append(rootfs.layers, descriptor{MediaType: mediaType, Digest: layer.Digest, Size: size})
+	}
+	return rootfs, nil
+}
+
+// importDockerArchive imports the layers of the only image in an uncompressed
+// `docker save` tarball as they are, taking their diff IDs from the image
+// config.
+func (s *storeManager) importDockerArchive(archivePath string) (*stackRootfs, error) {
+	var archiveManifest []struct {
+		Config string
+		Layers []string
+	}
+	err := eachTarEntry(archivePath, func(header *tar.Header, r io.Reader) error {
+		if header.Name != "manifest.json" {
+			return nil
+		}
+		return json.NewDecoder(r).Decode(&archiveManifest)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading docker-archive manifest: %s", err)
+	}
+	if len(archiveManifest) != 1 {
+		return nil, fmt.Errorf("rootfs is neither gzipped nor a docker-archive of exactly one image")
+	}
+
+	var config imageConfig
+	layers := map[string]descriptor{}
+	layerLinks := map[string]string{}
+	err = eachTarEntry(archivePath, func(header *tar.Header, r io.Reader) error {
+		switch {
+		case header.Name == archiveManifest[0].Config:
+			return json.NewDecoder(r).Decode(&config)
+		case !containsString(archiveManifest[0].Layers, header.Name):
+			return nil
+		case header.Typeflag == tar.TypeSymlink:
+			// docker save links layers it has already written
+			layerLinks[header.Name] = path.Join(path.Dir(header.Name), header.Linkname)
+			return nil
+		}
+
+		buffered := bufio.NewReader(r)
+		gzipped, err := isGzipped(buffered)
+		if err != nil {
+			return err
+		}
+		checksum, size, err := s.importBlob(buffered)
+		if err != nil {
+			return err
+		}
+		desc := descriptor{MediaType: uncompressedLayerMediaType, Digest: "sha256:" + checksum, Size: size}
+		if gzipped {
+			desc.MediaType = layerMediaType
+		}
+		layers[header.Name] = desc
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("importing docker-archive layers: %s", err)
+	}
+	if len(config.Rootfs.DiffIDs) != len(archiveManifest[0].Layers) {
+		return nil, fmt.Errorf("docker-archive image has %d layers but %d diff IDs", len(archiveManifest[0].Layers), len(config.Rootfs.DiffIDs))
+	}
+
+	rootfs := &stackRootfs{diffIDs: config.Rootfs.DiffIDs}
+	for _, layerName := range archiveManifest[0].Layers {
+		if target, ok := layerLinks[layerName]; ok {
+			layerName = target
+		}
+		desc, ok := layers[layerName]
+		if !ok {
+			return nil, fmt.Errorf("docker-archive is missing layer %s", layerName)
+		}
+		rootfs.layers = append(rootfs.layers, desc)
+	}
+	return rootfs, nil
+}
+
+// importBlob copies a blob into the store, returning its checksum and size.
+func (s *storeManager) importBlob(r io.Reader) (string, int64, error) {
+	file, err := os.Create(filepath.Join(s.path, uuid.New()))
+	if err != nil {
+		return "", 0, fmt.Errorf("opening temporary blob file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	summer := sha256.New()
+	counter := new(byteCounter)
+	if _, err := io.Copy(io.MultiWriter(file, summer, counter), r); err != nil {
+		return "", 0, fmt.Errorf("writing blob to store: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", 0, fmt.Errorf("closing temporary blob file: %s", err)
+	}
+
+	checksum := hex.EncodeToString(summer.Sum(nil))
+	if err := os.Rename(file.Name(), s.blobPath(checksum)); err != nil {
+		return "", 0, fmt.Errorf("moving blob into store: %s", err)
+	}
+	return checksum, counter.size, nil
+}
+
+// lookupVcapUser finds the uid and gid of the vcap user in the /etc/passwd of
+// the topmost layer that has one.
+func (s *storeManager) lookupVcapUser(layers []descriptor) (int, int, error) {
+	var passwd []byte
+	for _, layer := range layers {
+		checksum, err := digestHex(layer.Digest)
+		if err != nil {
+			return 0, 0, err
+		}
+		layerPasswd, err := readPasswd(s.blobPath(checksum), layer.MediaType == layerMediaType)
+		if err != nil {
+			return 0, 0, err
+		}
+		if layerPasswd != nil {
+			passwd = layerPasswd
+		}
+	}
+
+	for _, line := range strings.Split(string(passwd), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 || fields[0] != "vcap" {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, 0, fmt.Errorf("parsing vcap uid: %s", err)
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return 0, 0, fmt.Errorf("parsing vcap gid: %s", err)
+		}
+		return uid, gid, nil
+	}
+
+	return 0, 0, fmt.Errorf("no vcap user in rootfs /etc/passwd")
+}
+
+// readPasswd returns the contents of /etc/passwd in a layer tarball, or nil
+// if the layer doesn't have one.
+func readPasswd(layerPath string, gzipped bool) ([]byte, error) {
+	layerFile, err := os.Open(layerPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening rootfs layer: %s", err)
+	}
+	defer layerFile.Close()
+
+	var layerReader io.Reader = layerFile
+	if gzipped {
+		zipReader, err := gzip.NewReader(layerFile)
+		if err != nil {
+			return nil, fmt.Errorf("treating rootfs layer as gzip: %s", err)
+		}
+		defer zipReader.Close()
+		layerReader = zipReader
+	}
+
+	tarReader := tar.NewReader(layerReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rootfs tar iteration error: %s", err)
+		}
+
+		if path.Clean("/"+header.Name) == "/etc/passwd" {
+			return ioutil.ReadAll(tarReader)
+		}
+	}
+}
+
+// checksumGzippedLayer calculates the checksum, diff ID and size of a
+// gzipped layer in a single read.
+func checksumGzippedLayer(r io.Reader) (string, string, int64, error) {
+	type diffIDResult struct {
+		diffID string
+		err    error
+	}
+	pipeR, pipeW := io.Pipe()
+	diffIDResults := make(chan diffIDResult, 1)
+	go func() {
+		diffID, err := uncompressedDigest(pipeR)
+		pipeR.CloseWithError(err)
+		diffIDResults <- diffIDResult{diffID, err}
+	}()
+
+	summer := sha256.New()
+	counter := new(byteCounter)
+	_, err := io.Copy(io.MultiWriter(pipeW, summer, counter), r)
+	pipeW.CloseWithError(err)
+	result := <-diffIDResults
+	if result.err != nil {
+		return "", "", 0, fmt.Errorf("checksumming uncompressed layer: %s", result.err)
+	}
+	if err != nil {
+		return "", "", 0, fmt.Errorf("checksumming layer: %s", err)
+	}
+
+	return hex.EncodeToString(summer.Sum(nil)), result.diffID, counter.size, nil
+}
+
+func uncompressedDigest(r io.Reader) (string, error) {
+	uncompressedReader, err := gzip.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+	defer uncompressedReader.Close()
+
+	uncompressedSummer := sha256.New()
+	if _, err := io.Copy(uncompressedSummer, uncompressedReader); err != nil {
+		return "", err
+	}
+	// drain anything after the gzip stream so the writer isn't blocked
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(uncompressedSummer.Sum(nil)), nil
+}
+
+func dockerLayerMediaType(mediaType string) (string, error) {
+	switch mediaType {
+	case layerMediaType, ociLayerMediaType:
+		return layerMediaType, nil
+	case uncompressedLayerMediaType, ociUncompressedLayerMediaType:
+		return uncompressedLayerMediaType, nil
+	}
+	return "", fmt.Errorf("unsupported layer media type %s", mediaType)
+}
+
+func isGzipped(r *bufio.Reader) (bool, error) {
+	magic, err := r.Peek(2)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// inodeKey identifies the file behind a path with more than one hardlink.
+func inodeKey(info os.FileInfo) (string, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino), true
+}
+
+func eachTarEntry(tarPath string, fn func(*tar.Header, io.Reader) error) error {
+	tarFile, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer tarFile.Close()
+
+	tarReader := tar.NewReader(tarFile)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(header, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
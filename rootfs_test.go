@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *storeManager {
+	return &storeManager{path: t.TempDir(), logger: log.New(ioutil.Discard, "", 0)}
+}
+
+// vcapPasswd is an /etc/passwd with a vcap user of uid and gid id.
+func vcapPasswd(id string) string {
+	return "root:x:0:0:root:/root:/bin/bash\nvcap:x:" + id + ":" + id + "::/home/vcap:/bin/bash\n"
+}
+
+// layerTarball returns a layer of regular files, gzipped if asked.
+func layerTarball(t *testing.T, files map[string]string, gzipped bool) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	var zipWriter *gzip.Writer
+	tarWriter := tar.NewWriter(&buffer)
+	if gzipped {
+		zipWriter = gzip.NewWriter(&buffer)
+		tarWriter = tar.NewWriter(zipWriter)
+	}
+	for _, name := range names {
+		header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name])), ModTime: time.Unix(1500000000, 0)}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzipped {
+		if err := zipWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func gunzip(t *testing.T, gzipped []byte) []byte {
+	zipReader, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := ioutil.ReadAll(zipReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uncompressed
+}
+
+func digestOf(contents []byte) string {
+	return "sha256:" + checksumOf(contents)
+}
+
+func TestImportRootfsFromADirectory(t *testing.T) {
+	store := newTestStore(t)
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"etc/passwd": vcapPasswd("1000"), "bin/bash": "#!/bin/bash"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(dir, "bin", "bash"), filepath.Join(dir, "bin", "sh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bash", filepath.Join(dir, "bin", "rbash")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.importRootfs(defaultStack, dir); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := store.stackRootfs(defaultStack)
+	if len(rootfs.layers) != 1 || rootfs.layers[0].MediaType != layerMediaType || rootfs.vcapUID != 1000 || rootfs.vcapGID != 1000 {
+		t.Fatalf("imported %+v", rootfs)
+	}
+	layer, err := ioutil.ReadFile(store.blobPath(strings.TrimPrefix(rootfs.layers[0].Digest, "sha256:")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digestOf(layer) != rootfs.layers[0].Digest || digestOf(gunzip(t, layer)) != rootfs.diffIDs[0] {
+		t.Errorf("layer doesn't match its digest %s or diff ID %s", rootfs.layers[0].Digest, rootfs.diffIDs[0])
+	}
+
+	entries := layerEntries(t, store, rootfs.layers[0])
+	if bash := entries["bin/bash"]; bash == nil || bash.Typeflag != tar.TypeReg || bash.Size != int64(len("#!/bin/bash")) {
+		t.Errorf("bin/bash is %+v", bash)
+	}
+	if sh := entries["bin/sh"]; sh == nil || sh.Typeflag != tar.TypeLink || sh.Linkname != "bin/bash" {
+		t.Errorf("bin/sh is %+v, want a hardlink to bin/bash", sh)
+	}
+	if rbash := entries["bin/rbash"]; rbash == nil || rbash.Typeflag != tar.TypeSymlink || rbash.Linkname != "bash" {
+		t.Errorf("bin/rbash is %+v, want a symlink to bash", rbash)
+	}
+	if dir := entries["etc/"]; dir == nil || dir.Typeflag != tar.TypeDir {
+		t.Errorf("etc/ is %+v", dir)
+	}
+
+	digest := rootfs.layers[0].Digest
+	if err := store.importRootfs(defaultStack, dir); err != nil {
+		t.Fatal(err)
+	}
+	if again := store.stackRootfs(defaultStack).layers[0].Digest; again != digest {
+		t.Errorf("importing the same directory again gave %s, then %s", digest, again)
+	}
+}
+
+// writeOCILayout writes an OCI image layout of an image with layers, which
+// are gzipped or not, returning its directory.
+func writeOCILayout(t *testing.T, layers [][]byte, diffIDs []string) string {
+	dir := t.TempDir()
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeBlob := func(contents []byte) string {
+		if err := ioutil.WriteFile(filepath.Join(blobsDir, checksumOf(contents)), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return digestOf(contents)
+	}
+
+	configJSON, _ := json.Marshal(createImageConfig("", diffIDs...))
+	m := createManifest(descriptor{MediaType: ociConfigMediaType, Digest: writeBlob(configJSON), Size: int64(len(configJSON))})
+	m.MediaType = ociManifestMediaType
+	for _, layer := range layers {
+		mediaType := ociUncompressedLayerMediaType
+		if bytes.HasPrefix(layer, []byte{0x1f, 0x8b}) {
+			mediaType = ociLayerMediaType
+		}
+		m.Layers = append(m.Layers, descriptor{MediaType: mediaType, Digest: writeBlob(layer), Size: int64(len(layer))})
+	}
+	manifestJSON, _ := json.Marshal(m)
+	index := ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{{descriptor: descriptor{MediaType: ociManifestMediaType, Digest: writeBlob(manifestJSON), Size: int64(len(manifestJSON))}}}}
+	if err := writeJSONFile(filepath.Join(dir, "index.json"), index); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSONFile(filepath.Join(dir, "oci-layout"), map[string]string{"imageLayoutVersion": "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestImportRootfsFromAnOCILayout(t *testing.T) {
+	store := newTestStore(t)
+	base := layerTarball(t, map[string]string{"etc/passwd": vcapPasswd("1000"), "bin/bash": "#!/bin/bash"}, true)
+	update := layerTarball(t, map[string]string{"etc/passwd": vcapPasswd("3000")}, false)
+	diffIDs := []string{digestOf(gunzip(t, base)), digestOf(update)}
+
+	if err := store.importRootfs(defaultStack, writeOCILayout(t, [][]byte{base, update}, diffIDs)); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := store.stackRootfs(defaultStack)
+	want := []descriptor{
+		{MediaType: layerMediaType, Digest: digestOf(base), Size: int64(len(base))},
+		{MediaType: uncompressedLayerMediaType, Digest: digestOf(update), Size: int64(len(update))},
+	}
+	if !reflect.DeepEqual(rootfs.layers, want) || !reflect.DeepEqual(rootfs.diffIDs, diffIDs) {
+		t.Errorf("imported layers %+v with diff IDs %v, want %+v with %v", rootfs.layers, rootfs.diffIDs, want, diffIDs)
+	}
+	if rootfs.vcapUID != 3000 || rootfs.vcapGID != 3000 {
+		t.Errorf("vcap is %d:%d, want the topmost layer's 3000:3000", rootfs.vcapUID, rootfs.vcapGID)
+	}
+	for _, layer := range want {
+		if !storeHas(store, layer.Digest) {
+			t.Errorf("layer %s wasn't copied into the store", layer.Digest)
+		}
+	}
+
+	if err := store.importRootfs(defaultStack, writeOCILayout(t, [][]byte{base, update}, diffIDs[:1])); err == nil || !strings.Contains(err.Error(), "diff IDs") {
+		t.Errorf("importing an image with too few diff IDs: %v", err)
+	}
+}
+
+// writeDockerArchive writes an uncompressed `docker save` tarball of an image
+// with layers, linking any layer that has been written already the way
+// docker does.
+func writeDockerArchive(t *testing.T, layers [][]byte, diffIDs []string) string {
+	var buffer bytes.Buffer
+	tarWriter := tar.NewWriter(&buffer)
+	writeFile := func(header *tar.Header, contents []byte) {
+		header.Mode, header.Size = 0644, int64(len(contents))
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configJSON, _ := json.Marshal(createImageConfig("", diffIDs...))
+	writeFile(&tar.Header{Name: "config.json", Typeflag: tar.TypeReg}, configJSON)
+	written := map[string]string{}
+	var layerNames []string
+	for _, layer := range layers {
+		name := checksumOf(append(layer, byte(len(layerNames)))) + "/layer.tar"
+		if first, ok := written[digestOf(layer)]; ok {
+			writeFile(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: "../" + first}, nil)
+		} else {
+			writeFile(&tar.Header{Name: name, Typeflag: tar.TypeReg}, layer)
+			written[digestOf(layer)] = name
+		}
+		layerNames = append(layerNames, name)
+	}
+	manifestJSON, _ := json.Marshal([]map[string]interface{}{{"Config": "config.json", "Layers": layerNames}})
+	writeFile(&tar.Header{Name: "manifest.json", Typeflag: tar.TypeReg}, manifestJSON)
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "rootfs.tar")
+	if err := ioutil.WriteFile(archivePath, buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+func TestImportRootfsFromADockerArchive(t *testing.T) {
+	store := newTestStore(t)
+	base := layerTarball(t, map[string]string{"etc/passwd": vcapPasswd("1000"), "bin/bash": "#!/bin/bash"}, false)
+	update := layerTarball(t, map[string]string{"etc/hostname": "rootfs"}, true)
+	diffIDs := []string{digestOf(base), digestOf(gunzip(t, update)), digestOf(base)}
+
+	if err := store.importRootfs(defaultStack, writeDockerArchive(t, [][]byte{base, update, base}, diffIDs)); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := store.stackRootfs(defaultStack)
+	baseDesc := descriptor{MediaType: uncompressedLayerMediaType, Digest: digestOf(base), Size: int64(len(base))}
+	want := []descriptor{baseDesc, {MediaType: layerMediaType, Digest: digestOf(update), Size: int64(len(update))}, baseDesc}
+	if !reflect.DeepEqual(rootfs.layers, want) || !reflect.DeepEqual(rootfs.diffIDs, diffIDs) {
+		t.Errorf("imported layers %+v with diff IDs %v, want %+v with %v", rootfs.layers, rootfs.diffIDs, want, diffIDs)
+	}
+	if rootfs.vcapUID != 1000 || rootfs.vcapGID != 1000 {
+		t.Errorf("vcap is %d:%d, want 1000:1000", rootfs.vcapUID, rootfs.vcapGID)
+	}
+	if !storeHas(store, digestOf(base)) || !storeHas(store, digestOf(update)) {
+		t.Error("layers weren't copied into the store")
+	}
+
+	notAnArchive := filepath.Join(t.TempDir(), "rootfs.tar")
+	if err := ioutil.WriteFile(notAnArchive, base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.importRootfs(defaultStack, notAnArchive); err == nil || !strings.Contains(err.Error(), "docker-archive") {
+		t.Errorf("importing an uncompressed tarball that isn't a docker-archive: %v", err)
+	}
+}
+
+func TestAdminRootfsImportRebasesConvertedImages(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+	client := &dockerClient{t: t, registry: registry.URL}
+	appGUID := registry.pushApp(t, someAppDroplet)
+	before := client.pull(appGUID)
+	oldRootfs := registry.store.stackRootfs(defaultStack)
+	admin := httptest.NewServer(NewAdminAPI("127.0.0.1:0", registry.store, registryCredentials{}))
+	defer admin.Close()
+
+	importRootfs := func(rootfsPath string) *http.Response {
+		body, _ := json.Marshal(importRootfsRequest{Path: rootfsPath})
+		request, err := http.NewRequest("PUT", admin.URL+"/admin/stacks/"+defaultStack+"/rootfs", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response := importRootfs(filepath.Join(t.TempDir(), "missing"))
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnprocessableEntity || registry.store.stackRootfs(defaultStack) != oldRootfs {
+		t.Errorf("importing a missing rootfs responded %s", response.Status)
+	}
+
+	newRootfs := layerTarball(t, map[string]string{"etc/passwd": vcapPasswd("2000"), "etc/os-release": "cflinuxfs2 v2"}, true)
+	newRootfsPath := filepath.Join(t.TempDir(), "rootfs.tgz")
+	if err := ioutil.WriteFile(newRootfsPath, newRootfs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	response = importRootfs(newRootfsPath)
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		t.Fatalf("importing a rootfs responded %s: %s", response.Status, body)
+	}
+	var imported stackResponse
+	if err := json.NewDecoder(response.Body).Decode(&imported); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Stack != defaultStack || len(imported.Layers) != 1 || imported.Layers[0].Digest != digestOf(newRootfs) || imported.DiffIDs[0] != digestOf(gunzip(t, newRootfs)) {
+		t.Errorf("imported %+v", imported)
+	}
+
+	after := client.pull(appGUID)
+	if after.manifest.Layers[0].Digest != digestOf(newRootfs) || after.config.Rootfs.DiffIDs[0] != imported.DiffIDs[0] {
+		t.Errorf("manifest after the import is based on %s", after.manifest.Layers[0].Digest)
+	}
+	if !reflect.DeepEqual(after.manifest.Layers[1:], before.manifest.Layers[len(oldRootfs.layers):]) || !reflect.DeepEqual(after.config.Rootfs.DiffIDs[1:], before.config.Rootfs.DiffIDs[len(oldRootfs.layers):]) {
+		t.Errorf("app layers changed from %v to %v", before.manifest.Layers, after.manifest.Layers)
+	}
+	if after.layers[0]["etc/os-release"].contents != "cflinuxfs2 v2" {
+		t.Errorf("pulled rootfs layer has %v", after.layers[0])
+	}
+	for _, layer := range oldRootfs.layers {
+		if !storeHas(registry.store, layer.Digest) {
+			t.Errorf("old rootfs layer %s was removed", layer.Digest)
+		}
+	}
+}
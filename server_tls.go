@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader provides the registry's TLS certificate, and the CAs that
+// client certificates are verified against, reloading them from disk when
+// the files change so that certificates can be rotated without a restart.
+type certReloader struct {
+	certPath     string
+	keyPath      string
+	clientCAPath string
+	logger       *log.Logger
+
+	lock      sync.Mutex
+	checkedAt time.Time
+	modTimes  []time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// certCheckInterval limits how often the files are checked for changes.
+const certCheckInterval = time.Second
+
+func newCertReloader(certPath, keyPath, clientCAPath string, logger *log.Logger) (*certReloader, error) {
+	if certPath == "" || keyPath == "" {
+		return nil, fmt.Errorf("a TLS certificate and its key must be given together")
+	}
+
+	c := &certReloader{certPath: certPath, keyPath: keyPath, clientCAPath: clientCAPath, logger: logger}
+	modTimes, err := c.modTimesOnDisk()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTimes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: c.configForClient}
+}
+
+func (c *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.checkedAt) >= certCheckInterval {
+		c.checkedAt = time.Now()
+		c.reloadIfChanged()
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*c.cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.clientCAs != nil {
+		config.ClientCAs = c.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// reloadIfChanged keeps serving the previous certificates if the new ones
+// can't be loaded, e.g. because only one of the files has been replaced yet.
+func (c *certReloader) reloadIfChanged() {
+	modTimes, err := c.modTimesOnDisk()
+	if err != nil {
+		c.logger.Printf("not reloading TLS certificates: %s", err)
+		return
+	}
+	changed := false
+	for i := range modTimes {
+		changed = changed || !modTimes[i].Equal(c.modTimes[i])
+	}
+	if !changed {
+		return
+	}
+
+	if err := c.load(modTimes); err != nil {
+		c.logger.Printf("not reloading TLS certificates: %s", err)
+		return
+	}
+	c.logger.Println("reloaded TLS certificates")
+}
+
+func (c *certReloader) load(modTimes []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %s", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if c.clientCAPath != "" {
+		caCerts, err := ioutil.ReadFile(c.clientCAPath)
+		if err != nil {
+			return fmt.Errorf("reading client CA certificates: %s", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caCerts) {
+			return fmt.Errorf("no PEM certificates in %s", c.clientCAPath)
+		}
+	}
+
+	c.cert, c.clientCAs, c.modTimes = &cert, clientCAs, modTimes
+	return nil
+}
+
+func (c *certReloader) modTimesOnDisk() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, path := range []string{c.certPath, c.keyPath, c.clientCAPath} {
+		if path == "" {
+			modTimes = append(modTimes, time.Time{})
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "spikistry test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), serial: 1}
+}
+
+// issue returns a PEM certificate for 127.0.0.1 and its key, usable by
+// servers and clients.
+func (ca *testCA) issue(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// writeTestFile writes a file with a modification time of modified.
+func writeTestFile(t *testing.T, filePath string, contents []byte, modified time.Time) {
+	if err := ioutil.WriteFile(filePath, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filePath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTLSTestServer(t *testing.T, certs *certReloader) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	server.TLS = certs.tlsConfig()
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// servedCertificate returns the common name of the certificate a new
+// handshake with server gets.
+func servedCertificate(t *testing.T, server *httptest.Server, roots *x509.CertPool) string {
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificatesAreReloadedWhenRotated(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, key := ca.issue(t, "first")
+	writeTestFile(t, certPath, cert, time.Now().Add(-time.Minute))
+	writeTestFile(t, keyPath, key, time.Now().Add(-time.Minute))
+
+	certs, err := newCertReloader(certPath, keyPath, "", log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTLSTestServer(t, certs)
+	if name := servedCertificate(t, server, ca.pool()); name != "first" {
+		t.Fatalf("served %q before rotating", name)
+	}
+
+	rotated := func() {
+		certs.lock.Lock()
+		certs.checkedAt = time.Time{}
+		certs.lock.Unlock()
+	}
+	cert, key = ca.issue(t, "second")
+	writeTestFile(t, certPath, cert, time.Now())
+	rotated()
+	if name := servedCertificate(t, server, ca.pool()); name != "first" {
+		t.Errorf("served %q while only the certificate had been replaced", name)
+	}
+	writeTestFile(t, keyPath, key, time.Now())
+	rotated()
+	if name := servedCertificate(t, server, ca.pool()); name != "second" {
+		t.Errorf("served %q after rotating", name)
+	}
+}
+
+func TestClientCertificatesAreRequired(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPath, keyPath, clientCAPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "client-ca.pem")
+	cert, key := ca.issue(t, "registry")
+	writeTestFile(t, certPath, cert, time.Now())
+	writeTestFile(t, keyPath, key, time.Now())
+	clientCA := newTestCA(t)
+	writeTestFile(t, clientCAPath, clientCA.pem, time.Now())
+
+	certs, err := newCertReloader(certPath, keyPath, clientCAPath, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTLSTestServer(t, certs)
+
+	get := func(clientCerts ...tls.Certificate) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool(), Certificates: clientCerts}}}
+		response, err := client.Get(server.URL)
+		if err == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(); err == nil {
+		t.Error("served a client without a certificate")
+	}
+	untrustedCert, untrustedKey := ca.issue(t, "untrusted client")
+	untrusted, err := tls.X509KeyPair(untrustedCert, untrustedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(untrusted); err == nil {
+		t.Error("served a client whose certificate isn't from the client CA")
+	}
+	clientCert, clientKey := clientCA.issue(t, "client")
+	trusted, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(trusted); err != nil {
+		t.Errorf("refused a client with a certificate from the client CA: %s", err)
+	}
+}
@@ -3,231 +3,542 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
-	"crypto/sha256"
-	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
 	"github.com/pborman/uuid"
 )
 
-var httpClient *http.Client
+type storeManager struct {
+	path        string
+	capi        *capi.Client
+	logger      *log.Logger
+	splitLayers bool
+	// ociLayout is set if the store has the OCI layout rather than the flat one.
+	ociLayout bool
+	// maxDropletCacheBytes limits the total size of downloaded droplets kept
+	// once they have been converted, if it is positive. They are only needed
+	// again to convert them differently.
+	maxDropletCacheBytes int64
+	// callerIdentity is set when CAPI calls are made with the token of the
+	// user pulling an image, in which case CAPI is asked whether they may
+	// download the app's droplet even if it has been converted already.
+	callerIdentity bool
+
+	stacksLock sync.RWMutex
+	stacks     map[string]*stackRootfs
+
+	// manifestsLock serialises updates of the records of apps' manifests
+	manifestsLock sync.Mutex
+	// pushesLock serialises updates of the records of pushed blobs
+	pushesLock sync.Mutex
+}
 
-func init() {
-	httpClient = &http.Client{Transport: &http.Transport{
-		// SPIKE
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}}
+type unknownStackError struct {
+	appGUID string
+	stack   string
 }
 
-type storeManager struct {
-	path          string
-	capiURL       string
-	capiAuthToken string
-	logger        *log.Logger
+func (e unknownStackError) Error() string {
+	return fmt.Sprintf("app %s runs on stack %s, which this registry has no rootfs for", e.appGUID, e.stack)
+}
+
+type unknownManifestError struct {
+	appGUID string
+	digest  string
+}
+
+func (e unknownManifestError) Error() string {
+	return fmt.Sprintf("app %s has no manifest with digest %s", e.appGUID, e.digest)
+}
 
-	rootfsDesc   descriptor
-	rootfsDiffID string
+// convertedDroplet records the layers a droplet was converted into. They are
+// rebased onto the current rootfs of their stack whenever a manifest is built,
+// which works because app layers are purely additive.
+type convertedDroplet struct {
+	VcapUID     int          `json:"vcap_uid"`
+	VcapGID     int          `json:"vcap_gid"`
+	SplitLayers bool         `json:"split_layers"`
+	Layers      []descriptor `json:"layers"`
+	DiffIDs     []string     `json:"diff_ids"`
+}
+
+// appManifests records the manifests that have been served for an app, by
+// digest, so that they can be pulled by digest once the app has moved on to
+// another droplet or rootfs. The manifests themselves are blobs.
+type appManifests struct {
+	Manifests map[string]manifestRecord `json:"manifests"`
+}
+
+type manifestRecord struct {
+	DropletGUID string    `json:"droplet_guid"`
+	Created     time.Time `json:"created"`
+}
+
+// newest returns the checksum of the manifest recorded last, or an empty
+// string if there are none.
+func (m appManifests) newest() string {
+	var newest string
+	for manifestChecksum, record := range m.Manifests {
+		if newest == "" || record.Created.After(m.Manifests[newest].Created) {
+			newest = manifestChecksum
+		}
+	}
+	return newest
 }
 
-func (s *storeManager) AppManifest(dest io.Writer, appGUID string) {
+// AppManifest writes the manifest of an app's image, making any CAPI calls
+// with cf.
+func (s *storeManager) AppManifest(dest io.Writer, appGUID string, cf *capi.Client) error {
 	s.logger.Printf("getting manifest for app %s...", appGUID)
 	defer s.logger.Printf("done getting manifest for app %s", appGUID)
 
-	// This spike doesn't support apps whose names are valid hex-encoded sha256
-	cachedManifestPath := filepath.Join(s.path, appGUID+"-manifest")
-	cachedManifestFile, err := os.Open(cachedManifestPath)
-	if err == nil {
-		s.logger.Println("manifest and associated layers already cached")
-		_, err = io.Copy(dest, cachedManifestFile)
-		must("copy cached manifest", err)
-		cachedManifestFile.Close()
-		return
+	// CAPI is asked for the current droplet even when it has been converted
+	// already, so that restages are picked up and CAPI can refuse callers who
+	// may not see the app.
+	droplet, err := currentDroplet(cf, appGUID)
+	if err != nil {
+		return err
+	}
+	key, err := dropletKey(droplet)
+	if err != nil {
+		return fmt.Errorf("droplet %s of app %s: %s", droplet.GUID, appGUID, err)
+	}
+	rootfs := s.stackRootfs(droplet.Stack)
+	if rootfs == nil {
+		return unknownStackError{appGUID: appGUID, stack: droplet.Stack}
 	}
-	if !os.IsNotExist(err) {
-		must("should never happen", err)
+
+	if s.callerIdentity {
+		if err := cf.CheckDropletDownload(droplet.GUID); err != nil {
+			return fmt.Errorf("checking droplet %s: %w", droplet.GUID, err)
+		}
 	}
 
-	appLayerDesc, appLayerDiffID := s.importAppLayer(appGUID)
+	manifestJson, err := s.dropletManifest("droplet "+droplet.GUID, key, rootfs, "", func() (string, error) {
+		return s.downloadDroplet(droplet, cf)
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.recordManifest(appGUID, droplet.GUID, manifestJson); err != nil {
+		return err
+	}
+
+	_, err = dest.Write(manifestJson)
+	return err
+}
+
+// dropletManifest builds the manifest of a droplet's image on top of a
+// rootfs, converting the droplet unless it has been converted already. fetch
+// returns the path of the droplet tarball, and is only called to convert it.
+// A non-empty command becomes the image's Cmd. The manifest isn't stored.
+func (s *storeManager) dropletManifest(name, key string, rootfs *stackRootfs, command string, fetch func() (string, error)) ([]byte, error) {
+	var app convertedDroplet
+	convertedPath := filepath.Join(s.path, key+"-layers")
+	err := readJSONFile(convertedPath, &app)
+	if err == nil {
+		s.logger.Printf("%s already converted", name)
+		if rootfs.vcapUID != app.VcapUID || rootfs.vcapGID != app.VcapGID || s.splitLayers != app.SplitLayers {
+			s.logger.Printf("vcap user or layer splitting has changed, converting droplet again")
+			err = os.ErrNotExist
+		}
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading converted droplet: %s", err)
+		}
 
-	appConfig := createImageConfig(s.rootfsDiffID, appLayerDiffID)
+		dropletPath, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		app = convertedDroplet{VcapUID: rootfs.vcapUID, VcapGID: rootfs.vcapGID, SplitLayers: s.splitLayers}
+		app.Layers, app.DiffIDs, err = s.convertDroplet(name, dropletPath, rootfs)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeJSONFile(convertedPath, app); err != nil {
+			return nil, fmt.Errorf("recording converted droplet: %s", err)
+		}
+		if err := s.pruneDroplets(); err != nil {
+			s.logger.Printf("pruning droplet cache: %s", err)
+		}
+	}
+
+	appConfig := createImageConfig(command, append(append([]string{}, rootfs.diffIDs...), app.DiffIDs...)...)
 	configJson, err := json.Marshal(appConfig)
 	must("marshalling config", err)
-	checksumBytes := sha256.Sum256(configJson)
-	checksum := hex.EncodeToString(checksumBytes[:])
-	must("write config json", ioutil.WriteFile(filepath.Join(s.path, checksum), configJson, 0600))
+	checksum := checksumOf(configJson)
+	if err := ioutil.WriteFile(s.blobPath(checksum), configJson, 0600); err != nil {
+		return nil, fmt.Errorf("writing config json: %s", err)
+	}
 	configDesc := configDescriptor(checksum, int64(len(configJson)))
 
-	manifest := createManifest(configDesc, s.rootfsDesc, appLayerDesc)
+	manifest := createManifest(configDesc, append(append([]descriptor{}, rootfs.layers...), app.Layers...)...)
+	manifestJson, err := json.Marshal(manifest)
+	must("marshalling manifest", err)
+	return manifestJson, nil
+}
 
-	cachedManifestFile, err = os.OpenFile(cachedManifestPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-	must("opening manifest for writing", err)
-	defer cachedManifestFile.Close()
+// storeManifest stores a manifest as a blob, returning its checksum.
+func (s *storeManager) storeManifest(manifestJson []byte) (string, error) {
+	checksum := checksumOf(manifestJson)
+	manifestPath := s.blobPath(checksum)
+	if fileExists(manifestPath) {
+		// Touched so that gc doesn't remove it before it has been recorded.
+		now := time.Now()
+		if err := os.Chtimes(manifestPath, now, now); err != nil {
+			return "", fmt.Errorf("touching manifest: %s", err)
+		}
+	} else if err := ioutil.WriteFile(manifestPath, manifestJson, 0600); err != nil {
+		return "", fmt.Errorf("writing manifest: %s", err)
+	}
+	return checksum, nil
+}
+
+// recordManifest stores a manifest as a blob and adds it to the app's
+// manifests.
+func (s *storeManager) recordManifest(appGUID, dropletGUID string, manifestJson []byte) error {
+	checksum, err := s.storeManifest(manifestJson)
+	if err != nil {
+		return err
+	}
 
-	must("copy new manifest", json.NewEncoder(io.MultiWriter(dest, cachedManifestFile)).Encode(manifest))
+	s.manifestsLock.Lock()
+	defer s.manifestsLock.Unlock()
+
+	manifests, err := s.appManifests(appGUID)
+	if err != nil {
+		return err
+	}
+	if _, ok := manifests.Manifests[checksum]; ok {
+		return nil
+	}
+	if manifests.Manifests == nil {
+		manifests.Manifests = map[string]manifestRecord{}
+	}
+	manifests.Manifests[checksum] = manifestRecord{DropletGUID: dropletGUID, Created: time.Now().UTC()}
+	if err := writeJSONFile(s.appManifestsPath(appGUID), manifests); err != nil {
+		return fmt.Errorf("recording manifests of app %s: %s", appGUID, err)
+	}
+	return s.writeIndex()
 }
 
-func (s *storeManager) GetBlob(dest io.Writer, blobChecksum string) {
-	blobFile, err := os.Open(filepath.Join(s.path, blobChecksum))
-	must("open blob file", err)
-	defer blobFile.Close()
-	_, err = io.Copy(dest, blobFile)
-	must("copy blob", err)
+func (s *storeManager) appManifestsPath(appGUID string) string {
+	return filepath.Join(s.path, "app-"+appGUID+"-manifests")
 }
 
-func uncompressedChecksum() (chan string, *os.File) {
-	pipeR, pipeW, err := os.Pipe()
-	must("mkpipes", err)
-	uncompressedSummer := sha256.New()
-	result := make(chan string)
-	go func() {
-		uncompressedReader, err := gzip.NewReader(pipeR)
-		must("treat file as gzip", err)
-		defer uncompressedReader.Close()
-		_, err = io.Copy(uncompressedSummer, uncompressedReader)
-		must("copy uncompressed file", err)
-		result <- "sha256:" + hex.EncodeToString(uncompressedSummer.Sum(nil))
-		pipeR.Close()
-	}()
+// appManifests returns the manifests served for an app, which are none if it
+// has never been pulled.
+func (s *storeManager) appManifests(appGUID string) (appManifests, error) {
+	var manifests appManifests
+	err := readJSONFile(s.appManifestsPath(appGUID), &manifests)
+	if err != nil && !os.IsNotExist(err) {
+		return appManifests{}, fmt.Errorf("reading manifests of app %s: %s", appGUID, err)
+	}
+	return manifests, nil
+}
+
+// AppHasBlob reports whether a blob is the config or a layer of one of the
+// manifests served for an app, and is still in the store.
+func (s *storeManager) AppHasBlob(appGUID, blobChecksum string) (bool, error) {
+	manifests, err := s.appManifests(appGUID)
+	if err != nil {
+		return false, err
+	}
 
-	return result, pipeW
+	for manifestChecksum := range manifests.Manifests {
+		var m manifest
+		if err := readJSONFile(s.blobPath(manifestChecksum), &m); err != nil {
+			return false, fmt.Errorf("reading manifest %s: %s", manifestChecksum, err)
+		}
+		for _, desc := range append([]descriptor{m.Config}, m.Layers...) {
+			if desc.Digest == "sha256:"+blobChecksum {
+				return fileExists(s.blobPath(blobChecksum)), nil
+			}
+		}
+	}
+	return false, nil
 }
 
-func (s *storeManager) importRootfs(rootfsPath string) {
-	s.logger.Printf("importing rootfs from %s...", rootfsPath)
-	defer s.logger.Printf("done importing rootfs from %s", rootfsPath)
+// AppManifestByDigest writes a manifest that has been served for an app
+// before, whichever droplet it currently runs. With callerIdentity set, CAPI
+// is still asked whether the caller may download the app's droplet.
+func (s *storeManager) AppManifestByDigest(dest io.Writer, appGUID, manifestChecksum string, cf *capi.Client) error {
+	if s.callerIdentity {
+		droplet, err := currentDroplet(cf, appGUID)
+		if err != nil {
+			return err
+		}
+		if err := cf.CheckDropletDownload(droplet.GUID); err != nil {
+			return fmt.Errorf("checking droplet %s: %w", droplet.GUID, err)
+		}
+	}
 
-	must("create store", os.MkdirAll(s.path, 0700))
+	manifests, err := s.appManifests(appGUID)
+	if err != nil {
+		return err
+	}
+	if _, ok := manifests.Manifests[manifestChecksum]; !ok {
+		return unknownManifestError{appGUID: appGUID, digest: "sha256:" + manifestChecksum}
+	}
 
-	originalRootfs, err := os.Open(rootfsPath)
-	must("open rootfs", err)
-	defer originalRootfs.Close()
-	rootfsInfo, err := originalRootfs.Stat()
-	must("stat rootfs", err)
-	originalRootfsSize := rootfsInfo.Size()
+	manifestFile, err := s.OpenBlob(manifestChecksum)
+	if err != nil {
+		return fmt.Errorf("opening manifest: %s", err)
+	}
+	defer manifestFile.Close()
+	_, err = io.Copy(dest, manifestFile)
+	return err
+}
 
-	s.logger.Println("calculating rootfs compressed and uncompressed checksums...")
-	summer := sha256.New()
-	uncompressedChecksumResult, pipeW := uncompressedChecksum()
+// OpenBlob opens a blob in the store by the hex of its sha256 digest.
+func (s *storeManager) OpenBlob(blobChecksum string) (*os.File, error) {
+	return os.Open(s.blobPath(blobChecksum))
+}
+
+const dropletDownloadAttempts = 4
 
-	tee := io.MultiWriter(pipeW, summer)
+// dropletDownloadBackoff is the delay before the first retry of a droplet
+// download, doubling for each one after.
+var dropletDownloadBackoff = time.Second
 
-	_, err = io.Copy(tee, originalRootfs)
-	must("checksum rootfs", err)
-	pipeW.Close()
-	diffID := <-uncompressedChecksumResult
-	checksum := hex.EncodeToString(summer.Sum(nil))
-	s.rootfsDesc = layerDescriptor(checksum, originalRootfsSize)
-	s.rootfsDiffID = diffID
+// downloadDroplet downloads a droplet into the store, unless it is there
+// already, verifying it against the checksum CAPI reports for it.
+func (s *storeManager) downloadDroplet(droplet capi.Droplet, cf *capi.Client) (string, error) {
+	s.logger.Printf("downloading droplet %s...", droplet.GUID)
+	defer s.logger.Printf("done downloading droplet %s", droplet.GUID)
 
-	storedRootfsPath := filepath.Join(s.path, checksum)
-	_, err = os.Stat(storedRootfsPath)
+	key, err := dropletKey(droplet)
+	if err != nil {
+		return "", err
+	}
+	dropletPath := filepath.Join(s.path, key)
+	_, err = os.Stat(dropletPath)
 	if err == nil {
-		s.logger.Println("rootfs already cached")
-		return
+		return dropletPath, nil
 	}
-	if !os.IsNotExist(err) {
-		must("stat cached rootfs", err)
+
+	backoff := dropletDownloadBackoff
+	for attempt := 1; ; attempt++ {
+		err = s.tryDownloadDroplet(cf, droplet, dropletPath)
+		if err == nil {
+			return dropletPath, nil
+		}
+		if _, ok := err.(retryableError); !ok || attempt == dropletDownloadAttempts {
+			return "", fmt.Errorf("downloading droplet %s: %w", droplet.GUID, err)
+		}
+
+		s.logger.Printf("downloading droplet %s failed, retrying in %s: %s", droplet.GUID, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	s.logger.Println("rootfs not cached, copying into store")
+}
 
-	_, err = originalRootfs.Seek(0, 0)
-	must("seek rootfs back to 0", err)
+// retryableError is a droplet download failure that may not happen again,
+// such as a connection error or a 5xx response.
+type retryableError struct {
+	error
+}
 
-	destFile, err := os.OpenFile(storedRootfsPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-	must("open new rootfs file in store for writing", err)
-	defer destFile.Close()
-	_, err = io.Copy(destFile, originalRootfs)
-	must("write rootfs file to store", err)
+func (e retryableError) Unwrap() error {
+	return e.error
 }
 
-func (s *storeManager) downloadDroplet(appGUID string) string {
-	s.logger.Printf("downloading droplet for app %s...", appGUID)
-	defer s.logger.Printf("done downloading droplet for app %s", appGUID)
+// isTransient reports whether a request failed in a way that may not happen
+// again: a 5xx response, or a connection that was refused, dropped or timed
+// out. Certificate errors and other responses are not transient.
+func isTransient(err error) bool {
+	var capiErr *capi.Error
+	if errors.As(err, &capiErr) {
+		return capiErr.StatusCode >= 500
+	}
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
 
-	dropletPath := filepath.Join(s.path, appGUID+"-droplet")
-	_, err := os.Stat(dropletPath)
-	if err == nil {
-		return dropletPath
+// tryDownloadDroplet downloads a droplet from CAPI, following redirects to
+// the blobstore. The droplet file is only created once it is complete and
+// matches its checksum.
+func (s *storeManager) tryDownloadDroplet(cf *capi.Client, droplet capi.Droplet, dropletPath string) error {
+	body, err := cf.DownloadDroplet(droplet.GUID)
+	if err != nil {
+		if isTransient(err) {
+			return retryableError{err}
+		}
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(filepath.Join(s.path, uuid.New()))
+	if err != nil {
+		return fmt.Errorf("creating droplet file: %s", err)
 	}
+	defer os.Remove(file.Name())
+	defer file.Close()
 
-	request, err := http.NewRequest("GET", fmt.Sprintf("%s/v2/apps/%s/droplet/download", s.capiURL, appGUID), nil)
-	must("create a request", err)
-	request.Header.Add("Authorization", s.capiAuthToken) // "bearer" is already prefixed in the result of `cf oauth-token`
+	summer := dropletChecksumHash(droplet)
+	if _, err := io.Copy(io.MultiWriter(file, summer), body); err != nil {
+		return retryableError{fmt.Errorf("writing droplet to a file: %s", err)}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing droplet file: %s", err)
+	}
 
-	response, err := httpClient.Do(request)
-	must("do a request", err)
-	defer response.Body.Close()
+	if checksum := hex.EncodeToString(summer.Sum(nil)); checksum != strings.ToLower(droplet.Checksum.Value) {
+		return fmt.Errorf("droplet has %s checksum %s, but CAPI reports %s", droplet.Checksum.Type, checksum, droplet.Checksum.Value)
+	}
+	return os.Rename(file.Name(), dropletPath)
+}
 
-	file, err := os.Create(dropletPath)
-	must("create app-droplet file", err)
-	defer file.Close()
+// pruneDroplets removes the oldest downloaded droplets until their total size
+// is within maxDropletCacheBytes.
+func (s *storeManager) pruneDroplets() error {
+	if s.maxDropletCacheBytes <= 0 {
+		return nil
+	}
 
-	_, err = io.Copy(file, response.Body)
-	must("write the droplet to a file", err)
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+	var droplets []os.FileInfo
+	var total int64
+	for _, file := range files {
+		if storeFileKindOf(file.Name()) == dropletFile && file.Mode().IsRegular() {
+			droplets = append(droplets, file)
+			total += file.Size()
+		}
+	}
+	sort.Slice(droplets, func(i, j int) bool {
+		return droplets[i].ModTime().Before(droplets[j].ModTime())
+	})
 
-	return dropletPath
+	for _, droplet := range droplets {
+		if total <= s.maxDropletCacheBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.path, droplet.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.logger.Printf("removed droplet %s from the cache", droplet.Name())
+		total -= droplet.Size()
+	}
+	return nil
 }
 
-func (s *storeManager) importAppLayer(appGUID string) (descriptor, string) {
-	s.logger.Printf("getting layer for app %s...", appGUID)
-	defer s.logger.Printf("done getting layer for app %s", appGUID)
+// convertDroplet converts a droplet tarball into one layer or, when
+// splitLayers is set, into a layer per entry in dropletLayers.
+func (s *storeManager) convertDroplet(name, dropletPath string, rootfs *stackRootfs) ([]descriptor, []string, error) {
+	s.logger.Printf("converting %s...", name)
+	defer s.logger.Printf("done converting %s", name)
 
-	dropletPath := s.downloadDroplet(appGUID)
 	dropletFile, err := os.Open(dropletPath)
-	must("open droplet tarball", err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening droplet tarball: %s", err)
+	}
 	defer dropletFile.Close()
 
 	zipReader, err := gzip.NewReader(dropletFile)
-	must("assuming droplet is gzipped", err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("droplet is not gzipped: %s", err)
+	}
 	tarReader := tar.NewReader(zipReader)
 
-	destFile, err := os.Create(filepath.Join(s.path, uuid.New()))
-	must("opening temporary file to re-tar droplet", err)
-	summer := sha256.New()
-	counter := new(byteCounter)
-	tee := io.MultiWriter(summer, destFile, counter)
-	zipWriter := gzip.NewWriter(tee)
-
-	uncompressedSummer := sha256.New()
+	layerNames := []string{"app"}
+	if s.splitLayers {
+		layerNames = dropletLayers
+	}
+	layers := map[string]*layerWriter{}
+	entries := map[string]int{}
+	written := map[string]string{}
+	defer func() {
+		for _, layer := range layers {
+			layer.abort()
+		}
+	}()
+	for _, name := range layerNames {
+		layer, err := newLayerWriter(s.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		layers[name] = layer
 
-	tarWriter := tar.NewWriter(io.MultiWriter(zipWriter, uncompressedSummer))
+		// Diego untars droplets into /home/vcap as the vcap user, so the
+		// parent directories must exist in the layer with the same ownership.
+		if err := layer.WriteHeader(dirHeader("/home", 0, 0)); err != nil {
+			return nil, nil, fmt.Errorf("writing /home tar header: %s", err)
+		}
+		if err := layer.WriteHeader(dirHeader(dropletRoot, rootfs.vcapUID, rootfs.vcapGID)); err != nil {
+			return nil, nil, fmt.Errorf("writing %s tar header: %s", dropletRoot, err)
+		}
+	}
 
+	rewriter := newDropletRewriter(rootfs.vcapUID, rootfs.vcapGID)
 	for {
 		header, err := tarReader.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			must("droplet tar iteration error", err)
+			return nil, nil, fmt.Errorf("reading droplet tarball: %s", err)
 		}
 
-		header.Name = filepath.Join("/home/vcap", header.Name)
+		if err := rewriter.rewrite(header); err != nil {
+			return nil, nil, fmt.Errorf("%s is unsafe: %s", name, err)
+		}
+		// The droplet's ./ entry; /home/vcap has been written to every layer
+		// already, and anything else anchored there has been refused.
+		if header.Name == dropletRoot {
+			continue
+		}
 
-		err = tarWriter.WriteHeader(header)
-		must("write droplet tar header", err)
+		layerName := "app"
+		if s.splitLayers {
+			layerName = dropletLayer(header, written)
+			normaliseTimes(header)
+		}
+		entries[layerName]++
+		written[header.Name] = layerName
 
-		_, err = io.Copy(tarWriter, tarReader)
-		must("copy droplet tar entry", err)
-	}
-	must("close temporary droplet tarstream", tarWriter.Close())
-	must("close temporary droplet zipper", zipWriter.Close())
-	must("close temporary droplet file", destFile.Close())
+		if err := layers[layerName].WriteHeader(header); err != nil {
+			return nil, nil, fmt.Errorf("writing droplet tar header: %s", err)
+		}
 
-	checksum := hex.EncodeToString(summer.Sum(nil))
-	appLayerPath := filepath.Join(s.path, checksum)
-	must("move droplet into store", os.Rename(destFile.Name(), appLayerPath))
+		if _, err := io.Copy(layers[layerName], tarReader); err != nil {
+			return nil, nil, fmt.Errorf("copying droplet tar entry: %s", err)
+		}
+	}
 
-	appLayerFile, err := os.Open(appLayerPath)
-	must("opening app layer file", err)
-	defer appLayerFile.Close()
+	var descs []descriptor
+	var diffIDs []string
+	for _, name := range layerNames {
+		if entries[name] == 0 && name != "app" {
+			continue
+		}
+		desc, diffID, err := layers[name].commit(s.blobPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		descs = append(descs, desc)
+		diffIDs = append(diffIDs, diffID)
+	}
 
-	return layerDescriptor(checksum, counter.size), "sha256:" + hex.EncodeToString(uncompressedSummer.Sum(nil))
+	return descs, diffIDs, nil
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/masters-of-cats/droplet-registry-spike/capi"
+)
+
+const testCAPIToken = "bearer capi-token"
+
+func testDroplet(guid, contents string) capi.Droplet {
+	droplet := capi.Droplet{GUID: guid, Stack: "cflinuxfs2"}
+	checksum := sha256.Sum256([]byte(contents))
+	droplet.Checksum.Type = "sha256"
+	droplet.Checksum.Value = hex.EncodeToString(checksum[:])
+	return droplet
+}
+
+var someDroplet = testDroplet("some-droplet", "droplet contents")
+
+// newDropletServers starts a fake CAPI that redirects droplet downloads to a
+// fake blobstore on another host, which is served by blobstore.
+func newDropletServers(t *testing.T, blobstore http.HandlerFunc) *storeManager {
+	blobstoreServer := httptest.NewServer(blobstore)
+	t.Cleanup(blobstoreServer.Close)
+
+	capiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != testCAPIToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v3/droplets/some-droplet/download":
+			http.Redirect(w, r, blobstoreServer.URL+"/signed/droplet?signature=abc", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(capiServer.Close)
+
+	backoff := dropletDownloadBackoff
+	dropletDownloadBackoff = time.Millisecond
+	t.Cleanup(func() { dropletDownloadBackoff = backoff })
+	return &storeManager{
+		path:   t.TempDir(),
+		capi:   &capi.Client{URL: capiServer.URL, Token: testCAPIToken, HTTPClient: httpClient},
+		logger: log.New(ioutil.Discard, "", 0),
+	}
+}
+
+func TestDownloadDropletFollowsRedirectWithoutCredentials(t *testing.T) {
+	store := newDropletServers(t, func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("blobstore received Authorization header %q", auth)
+		}
+		w.Write([]byte("droplet contents"))
+	})
+
+	dropletPath, err := store.downloadDroplet(someDroplet, store.capi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(dropletPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "droplet contents" {
+		t.Errorf("droplet contents are %q", contents)
+	}
+}
+
+func TestDownloadDropletRetriesServerErrors(t *testing.T) {
+	var requests int32
+	store := newDropletServers(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("droplet contents"))
+	})
+
+	if _, err := store.downloadDroplet(someDroplet, store.capi); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Errorf("blobstore received %d requests, expected 3", requests)
+	}
+}
+
+func TestDownloadDropletRetriesConnectionErrors(t *testing.T) {
+	var requests int32
+	store := newDropletServers(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		w.Write([]byte("droplet contents"))
+	})
+
+	if _, err := store.downloadDroplet(someDroplet, store.capi); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("blobstore received %d requests, expected 2", requests)
+	}
+}
+
+func TestDownloadDropletGivesUpOnPersistentServerErrors(t *testing.T) {
+	var requests int32
+	store := newDropletServers(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	_, err := store.downloadDroplet(someDroplet, store.capi)
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("expected a 500 error, got %v", err)
+	}
+	if requests != dropletDownloadAttempts {
+		t.Errorf("blobstore received %d requests, expected %d", requests, dropletDownloadAttempts)
+	}
+	assertNoDroplet(t, store, someDroplet)
+}
+
+func TestDownloadDropletDoesNotRetryCertificateErrors(t *testing.T) {
+	store := newDropletServers(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("blobstore should not be reached")
+	})
+	var connections int32
+	untrusted := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("CAPI with an untrusted certificate should not be reached")
+	}))
+	untrusted.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	untrusted.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	untrusted.StartTLS()
+	defer untrusted.Close()
+	store.capi.URL = untrusted.URL
+
+	_, err := store.downloadDroplet(someDroplet, store.capi)
+	if err == nil || !strings.Contains(err.Error(), "x509") {
+		t.Fatalf("expected a certificate error, got %v", err)
+	}
+	if connections != 1 {
+		t.Errorf("CAPI received %d connections, expected 1", connections)
+	}
+	assertNoDroplet(t, store, someDroplet)
+}
+
+func TestDownloadDropletRejectsChecksumMismatches(t *testing.T) {
+	store := newDropletServers(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("corrupted droplet"))
+	})
+
+	_, err := store.downloadDroplet(someDroplet, store.capi)
+	if err == nil || !strings.Contains(err.Error(), "CAPI reports "+someDroplet.Checksum.Value) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	assertNoDroplet(t, store, someDroplet)
+}
+
+func TestDownloadDropletDoesNotSaveErrorResponses(t *testing.T) {
+	store := newDropletServers(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("blobstore should not be reached")
+	})
+
+	unknownDroplet := testDroplet("unknown-droplet", "other contents")
+	if _, err := store.downloadDroplet(unknownDroplet, store.capi); err == nil {
+		t.Fatal("expected an error for an unknown droplet")
+	}
+	assertNoDroplet(t, store, unknownDroplet)
+
+	if _, err := store.downloadDroplet(someDroplet, store.capi.WithToken("bearer wrong-token")); err == nil {
+		t.Fatal("expected an error for a wrong token")
+	}
+	assertNoDroplet(t, store, someDroplet)
+}
+
+func assertNoDroplet(t *testing.T, store *storeManager, droplet capi.Droplet) {
+	t.Helper()
+	key, err := dropletKey(droplet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(store.path, key)); !os.IsNotExist(err) {
+		t.Errorf("expected no file for droplet %s, got %v", droplet.GUID, err)
+	}
+}
+
+func TestImportedStacksAreLoaded(t *testing.T) {
+	registry := newTestRegistry(t, false, false)
+
+	restarted := &storeManager{path: registry.store.path, logger: log.New(ioutil.Discard, "", 0)}
+	if err := restarted.loadStacks(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, imported := restarted.stackRootfs(defaultStack), registry.store.stackRootfs(defaultStack)
+	if loaded == nil {
+		t.Fatalf("%s wasn't loaded", defaultStack)
+	}
+	if loaded.layers[0] != imported.layers[0] || loaded.diffIDs[0] != imported.diffIDs[0] || loaded.vcapUID != 2000 || loaded.vcapGID != 2000 {
+		t.Errorf("loaded %+v, imported %+v", loaded, imported)
+	}
+
+	if err := restarted.importRootfs("../escape", registry.store.path); err == nil {
+		t.Errorf("expected a stack name with a slash to be rejected")
+	}
+}
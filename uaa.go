@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// uaaClient authenticates registry users against UAA.
+type uaaClient struct {
+	url          string
+	clientID     string
+	clientSecret string
+}
+
+type uaaUser struct {
+	UserID   string `json:"user_id"`
+	UserName string `json:"user_name"`
+}
+
+type invalidCredentialsError struct {
+	reason string
+}
+
+func (e invalidCredentialsError) Error() string {
+	return "invalid credentials: " + e.reason
+}
+
+// passwordGrant exchanges a user's username and password for an access token.
+func (u *uaaClient) passwordGrant(username, password string) (string, error) {
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {username},
+		"password":   {password},
+	}
+	request, err := http.NewRequest("POST", u.url+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(u.clientID, u.clientSecret)
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := u.do(request, &token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// userInfo returns the user an access token belongs to, which also checks
+// that UAA still considers the token valid.
+func (u *uaaClient) userInfo(accessToken string) (uaaUser, error) {
+	request, err := http.NewRequest("GET", u.url+"/userinfo", nil)
+	if err != nil {
+		return uaaUser{}, err
+	}
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Authorization", "bearer "+accessToken)
+
+	var user uaaUser
+	if err := u.do(request, &user); err != nil {
+		return uaaUser{}, err
+	}
+	if user.UserID == "" {
+		return uaaUser{}, invalidCredentialsError{reason: "token does not belong to a user"}
+	}
+	return user, nil
+}
+
+func (u *uaaClient) do(request *http.Request, result interface{}) error {
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("contacting UAA: %s", err)
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+		return json.NewDecoder(response.Body).Decode(result)
+	case response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden:
+		var uaaErr struct {
+			Description string `json:"error_description"`
+		}
+		json.NewDecoder(response.Body).Decode(&uaaErr)
+		return invalidCredentialsError{reason: uaaErr.Description}
+	default:
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("UAA responded %s: %s", response.Status, body)
+	}
+}